@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Check if the pod could be scheduled on the node according to spec.nodeSelector and required node affinity
+// Node selector terms are ORed, expressions and fields inside one term are ANDed (as kube-scheduler does)
+// If config.Affinity is set, only expressions with listed keys and operators are taken into account
+func nodeMatchesAffinity(config *configType, node *v1.Node, podSpec *v1.PodSpec) bool {
+	for key, value := range podSpec.NodeSelector {
+		nodeValue, exists := node.Labels[key]
+		if !exists || nodeValue != value {
+			logK8s.Debug("node does not match nodeSelector", "node", node.Name, "key", key, "value", value)
+			return false
+		}
+	}
+
+	affinity := podSpec.Affinity
+	if affinity == nil || affinity.NodeAffinity == nil || affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return true
+	}
+
+	for _, term := range affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		if nodeMatchesSelectorTerm(config, node, &term) {
+			return true
+		}
+	}
+
+	logK8s.Debug("node does not match any node selector term", "node", node.Name)
+	return false
+}
+
+// Empty term matches no nodes
+func nodeMatchesSelectorTerm(config *configType, node *v1.Node, term *v1.NodeSelectorTerm) bool {
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return false
+	}
+
+	for _, expression := range term.MatchExpressions {
+		if !affinityExpressionIsChecked(config, &expression) {
+			continue
+		}
+
+		value, exists := node.Labels[expression.Key]
+		if !selectorRequirementMatches(&expression, value, exists) {
+			logK8s.Debug("node label does not match expression", "node", node.Name, "key", expression.Key, "operator", expression.Operator, "values", expression.Values)
+			return false
+		}
+	}
+
+	// The only field supported by kube-scheduler is metadata.name
+	for _, field := range term.MatchFields {
+		if field.Key != "metadata.name" {
+			return false
+		}
+
+		if !selectorRequirementMatches(&field, node.Name, true) {
+			logK8s.Debug("node field does not match expression", "node", node.Name, "key", field.Key, "operator", field.Operator, "values", field.Values)
+			return false
+		}
+	}
+
+	return true
+}
+
+func selectorRequirementMatches(requirement *v1.NodeSelectorRequirement, value string, exists bool) bool {
+	switch requirement.Operator {
+	case v1.NodeSelectorOpIn:
+		return exists && inList(value, requirement.Values)
+
+	case v1.NodeSelectorOpNotIn:
+		return !exists || !inList(value, requirement.Values)
+
+	case v1.NodeSelectorOpExists:
+		return exists
+
+	case v1.NodeSelectorOpDoesNotExist:
+		return !exists
+
+	case v1.NodeSelectorOpGt, v1.NodeSelectorOpLt:
+		if !exists || len(requirement.Values) != 1 {
+			return false
+		}
+
+		nodeNumber, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+
+		requiredNumber, err := strconv.ParseInt(requirement.Values[0], 10, 64)
+		if err != nil {
+			return false
+		}
+
+		if requirement.Operator == v1.NodeSelectorOpGt {
+			return nodeNumber > requiredNumber
+		}
+		return nodeNumber < requiredNumber
+	}
+
+	return false
+}
+
+// Without config.Affinity every expression is checked
+func affinityExpressionIsChecked(config *configType, expression *v1.NodeSelectorRequirement) bool {
+	if len(config.Affinity) == 0 {
+		return true
+	}
+
+	for _, configAffinity := range config.Affinity {
+		if expression.Key == configAffinity.Key && expression.Operator == configAffinity.Operator {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newAffinityPodSpec(terms ...v1.NodeSelectorTerm) *v1.PodSpec {
+	return &v1.PodSpec{
+		Affinity: &v1.Affinity{
+			NodeAffinity: &v1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{NodeSelectorTerms: terms},
+			},
+		},
+	}
+}
+
+func newExpressionTerm(key string, operator v1.NodeSelectorOperator, values ...string) v1.NodeSelectorTerm {
+	return v1.NodeSelectorTerm{
+		MatchExpressions: []v1.NodeSelectorRequirement{{Key: key, Operator: operator, Values: values}},
+	}
+}
+
+func TestSelectorRequirementMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		operator v1.NodeSelectorOperator
+		values   []string
+		value    string
+		exists   bool
+		want     bool
+	}{
+		{"in matches", v1.NodeSelectorOpIn, []string{"a", "b"}, "b", true, true},
+		{"in does not match", v1.NodeSelectorOpIn, []string{"a", "b"}, "c", true, false},
+		{"in without label", v1.NodeSelectorOpIn, []string{"a"}, "", false, false},
+		{"not in matches", v1.NodeSelectorOpNotIn, []string{"a"}, "c", true, true},
+		{"not in does not match", v1.NodeSelectorOpNotIn, []string{"a"}, "a", true, false},
+		{"not in without label", v1.NodeSelectorOpNotIn, []string{"a"}, "", false, true},
+		{"exists", v1.NodeSelectorOpExists, nil, "", true, true},
+		{"exists without label", v1.NodeSelectorOpExists, nil, "", false, false},
+		{"does not exist", v1.NodeSelectorOpDoesNotExist, nil, "", false, true},
+		{"does not exist with label", v1.NodeSelectorOpDoesNotExist, nil, "x", true, false},
+		{"gt", v1.NodeSelectorOpGt, []string{"4"}, "8", true, true},
+		{"gt equal", v1.NodeSelectorOpGt, []string{"8"}, "8", true, false},
+		{"lt", v1.NodeSelectorOpLt, []string{"8"}, "4", true, true},
+		{"lt not a number", v1.NodeSelectorOpLt, []string{"8"}, "four", true, false},
+		{"gt several values", v1.NodeSelectorOpGt, []string{"1", "2"}, "8", true, false},
+		{"gt without label", v1.NodeSelectorOpGt, []string{"1"}, "", false, false},
+		{"unknown operator", "Like", []string{"a"}, "a", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requirement := v1.NodeSelectorRequirement{Key: "key", Operator: test.operator, Values: test.values}
+
+			got := selectorRequirementMatches(&requirement, test.value, test.exists)
+			if got != test.want {
+				t.Errorf("selectorRequirementMatches() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNodeMatchesAffinity(t *testing.T) {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-1",
+			Labels: map[string]string{"zone": "1a", "hw": "cpu8"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		config  *configType
+		podSpec *v1.PodSpec
+		want    bool
+	}{
+		{
+			name:    "no selector and no affinity",
+			podSpec: &v1.PodSpec{},
+			want:    true,
+		},
+		{
+			name:    "node selector matches",
+			podSpec: &v1.PodSpec{NodeSelector: map[string]string{"zone": "1a"}},
+			want:    true,
+		},
+		{
+			name:    "node selector does not match",
+			podSpec: &v1.PodSpec{NodeSelector: map[string]string{"zone": "1b"}},
+			want:    false,
+		},
+		{
+			name:    "node selector label is missing",
+			podSpec: &v1.PodSpec{NodeSelector: map[string]string{"dc": "red"}},
+			want:    false,
+		},
+		{
+			name:    "terms are ORed",
+			podSpec: newAffinityPodSpec(newExpressionTerm("zone", v1.NodeSelectorOpIn, "1b"), newExpressionTerm("zone", v1.NodeSelectorOpIn, "1a")),
+			want:    true,
+		},
+		{
+			name: "expressions are ANDed",
+			podSpec: newAffinityPodSpec(v1.NodeSelectorTerm{
+				MatchExpressions: []v1.NodeSelectorRequirement{
+					{Key: "zone", Operator: v1.NodeSelectorOpIn, Values: []string{"1a"}},
+					{Key: "hw", Operator: v1.NodeSelectorOpNotIn, Values: []string{"cpu8"}},
+				},
+			}),
+			want: false,
+		},
+		{
+			name:    "empty term matches nothing",
+			podSpec: newAffinityPodSpec(v1.NodeSelectorTerm{}),
+			want:    false,
+		},
+		{
+			name:    "no terms match nothing",
+			podSpec: newAffinityPodSpec(),
+			want:    false,
+		},
+		{
+			name: "match fields by node name",
+			podSpec: newAffinityPodSpec(v1.NodeSelectorTerm{
+				MatchFields: []v1.NodeSelectorRequirement{{Key: "metadata.name", Operator: v1.NodeSelectorOpIn, Values: []string{"node-1"}}},
+			}),
+			want: true,
+		},
+		{
+			name: "match fields by other node name",
+			podSpec: newAffinityPodSpec(v1.NodeSelectorTerm{
+				MatchFields: []v1.NodeSelectorRequirement{{Key: "metadata.name", Operator: v1.NodeSelectorOpIn, Values: []string{"node-2"}}},
+			}),
+			want: false,
+		},
+		{
+			name: "match fields by unsupported field",
+			podSpec: newAffinityPodSpec(v1.NodeSelectorTerm{
+				MatchFields: []v1.NodeSelectorRequirement{{Key: "spec.unschedulable", Operator: v1.NodeSelectorOpIn, Values: []string{"false"}}},
+			}),
+			want: false,
+		},
+		{
+			name: "expression not listed in config is ignored",
+			config: &configType{Affinity: []struct {
+				Key      string
+				Value    string
+				Operator v1.NodeSelectorOperator
+			}{{Key: "zone", Operator: v1.NodeSelectorOpNotIn}}},
+			podSpec: newAffinityPodSpec(newExpressionTerm("hw", v1.NodeSelectorOpIn, "cpu1")),
+			want:    true,
+		},
+		{
+			name: "expression listed in config is checked",
+			config: &configType{Affinity: []struct {
+				Key      string
+				Value    string
+				Operator v1.NodeSelectorOperator
+			}{{Key: "zone", Operator: v1.NodeSelectorOpNotIn}}},
+			podSpec: newAffinityPodSpec(newExpressionTerm("zone", v1.NodeSelectorOpNotIn, "1a")),
+			want:    false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := test.config
+			if config == nil {
+				config = &configType{}
+			}
+
+			got := nodeMatchesAffinity(config, node, test.podSpec)
+			if got != test.want {
+				t.Errorf("nodeMatchesAffinity() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
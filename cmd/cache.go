@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	appsListersV1 "k8s.io/client-go/listers/apps/v1"
+	listersV1 "k8s.io/client-go/listers/core/v1"
+	nodeListersV1 "k8s.io/client-go/listers/node/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	informerResyncPeriod            = 10 * time.Minute
+	informerDefaultCacheSyncTimeout = 5 * time.Minute
+)
+
+// Forbidden or missing resources never sync, so waiting for caches is bounded
+var informerCacheSyncTimeout time.Duration
+
+// Listers are backed by shared informers, so reading from them does not hit the API server
+var (
+	nodeLister         listersV1.NodeLister
+	podLister          listersV1.PodLister
+	deploymentLister   appsListersV1.DeploymentLister
+	replicaSetLister   appsListersV1.ReplicaSetLister
+	statefulSetLister  appsListersV1.StatefulSetLister
+	daemonSetLister    appsListersV1.DaemonSetLister
+	rolloutLister      cache.GenericLister
+	runtimeClassLister nodeListersV1.RuntimeClassLister
+)
+
+// Start shared informers for nodes, pods and workloads and wait until their caches are filled
+// Rollouts informer is started only if some namespace uses it, Argo Rollouts CRD may be absent in the cluster
+func startInformers(stopCh <-chan struct{}, withRollouts bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), informerCacheSyncTimeout)
+	defer cancel()
+
+	clientset, err := getMetaV1Clientset()
+	if err != nil {
+		return err
+	}
+
+	factory := informers.NewSharedInformerFactory(clientset, informerResyncPeriod)
+
+	nodeLister = factory.Core().V1().Nodes().Lister()
+	podLister = factory.Core().V1().Pods().Lister()
+	deploymentLister = factory.Apps().V1().Deployments().Lister()
+	replicaSetLister = factory.Apps().V1().ReplicaSets().Lister()
+	statefulSetLister = factory.Apps().V1().StatefulSets().Lister()
+	daemonSetLister = factory.Apps().V1().DaemonSets().Lister()
+	runtimeClassLister = factory.Node().V1().RuntimeClasses().Lister()
+
+	factory.Start(stopCh)
+
+	for informerType, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("cannot sync informer cache for %v within %s, check that the resource exists and RBAC allows to list and watch it", informerType, informerCacheSyncTimeout)
+		}
+	}
+
+	if withRollouts {
+		client, err := getDynamicClient()
+		if err != nil {
+			return err
+		}
+
+		dynamicFactory := dynamicinformer.NewDynamicSharedInformerFactory(client, informerResyncPeriod)
+		rolloutLister = dynamicFactory.ForResource(rolloutResource).Lister()
+		dynamicFactory.Start(stopCh)
+
+		for informerResource, synced := range dynamicFactory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				return fmt.Errorf("cannot sync informer cache for %v within %s, check that the resource exists and RBAC allows to list and watch it", informerResource, informerCacheSyncTimeout)
+			}
+		}
+	}
+
+	logK8s.Info("informer caches are synced")
+	return nil
+}
@@ -1,56 +1,242 @@
 package main
 
-import "math"
+import (
+	"math"
 
-// Calculate how much CPU and Memory one RPS costs
-func calculateOneRPSCost(fullChainCPU, fullChainMemory, adjustedRPS int64) (float64, float64) {
+	v1 "k8s.io/api/core/v1"
+)
+
+// Calculate how much of every resource one RPS costs
+func calculateOneRPSCost(fullChain resourcesType, adjustedRPS int64) map[v1.ResourceName]float64 {
+	oneRPSCost := make(map[v1.ResourceName]float64)
+
+	for name, value := range fullChain {
+		if adjustedRPS == 0 {
+			oneRPSCost[name] = 0
+		} else {
+			oneRPSCost[name] = float64(value) / float64(adjustedRPS)
+		}
+	}
+
+	return oneRPSCost
+}
+
+// How many more RPS the app can take and what limits it
+type rpsHeadroomType struct {
+	RPS        float64
+	Namespace  string
+	Resource   v1.ResourceName
+	ByResource map[v1.ResourceName]float64
+}
+
+// Calculate how many additional RPS the app can take before the app itself or one of its dependencies runs out of a resource
+// One more RPS costs the app its own really occupied resources per RPS and the dependencies their share (ingress multiplier)
+// Namespaces which are counted on the same nodes pay from the same free resources, so every namespace's free resources
+// are divided by the summed cost of all chain namespaces sharing nodes with it, pod slots are counted as "pods"
+// Returns nil if the app has no RPS or one RPS costs nothing
+func calculateRPSHeadroom(config *configType, app string, appCapacities map[string]*appCapacityType, ingressMultipliers map[string]float64) *rpsHeadroomType {
+	var headroom *rpsHeadroomType
+	adjustedRPS := appCapacities[app].AdjustedRPS
 
 	if adjustedRPS == 0 {
-		return 0, 0
+		return nil
+	}
+
+	multiplier, multiplierExists := ingressMultipliers[app]
+	if !multiplierExists {
+		multiplier = 1
+	}
+
+	chain := []string{app}
+	for _, currentNamespace := range config.Namespaces {
+		if currentNamespace.Name == app {
+			chain = append(chain, currentNamespace.DependsOnFullChain...)
+		}
+	}
+
+	oneRPSCosts := make(map[string]map[v1.ResourceName]float64)
+	countedNodes := make(map[string]map[string]bool)
+	for _, namespace := range chain {
+		appCapacity := appCapacities[namespace]
+		share := multiplier
+		if namespace == app {
+			share = 1
+		}
+
+		occupied := make(resourcesType)
+		for name, value := range appCapacity.ReallyOccupied {
+			occupied[name] = value
+		}
+		occupied[v1.ResourcePods] = int64(appCapacity.Pods)
+
+		oneRPSCosts[namespace] = make(map[v1.ResourceName]float64)
+		for name, value := range occupied {
+			oneRPSCosts[namespace][name] = float64(value) * share / float64(adjustedRPS)
+		}
+
+		countedNodes[namespace] = make(map[string]bool)
+		for _, node := range appCapacity.Nodes {
+			if node.Counted {
+				countedNodes[namespace][node.Name] = true
+			}
+		}
+	}
+
+	for _, namespace := range chain {
+		appCapacity := appCapacities[namespace]
+
+		for name, oneRPSCost := range oneRPSCosts[namespace] {
+			// Resource which is not used does not limit RPS
+			if oneRPSCost <= 0 {
+				continue
+			}
+
+			// Chain namespaces sharing nodes with this one take their cost from the same free resources
+			for _, otherNamespace := range chain {
+				if otherNamespace != namespace && nodesOverlap(countedNodes[namespace], countedNodes[otherNamespace]) {
+					oneRPSCost += oneRPSCosts[otherNamespace][name]
+				}
+			}
+
+			resourceHeadroom := math.Max(float64(appCapacity.Free[name]), 0) / oneRPSCost
+			logCalc.Debug("RPS headroom of dependency", "namespace", app, "dependency", namespace, "resource", name, "headroom", resourceHeadroom)
+
+			if headroom == nil {
+				headroom = &rpsHeadroomType{RPS: resourceHeadroom, Namespace: namespace, Resource: name, ByResource: make(map[v1.ResourceName]float64)}
+			}
+
+			if resourceHeadroom < headroom.RPS {
+				headroom.RPS = resourceHeadroom
+				headroom.Namespace = namespace
+				headroom.Resource = name
+			}
+
+			byResource, exists := headroom.ByResource[name]
+			if !exists || resourceHeadroom < byResource {
+				headroom.ByResource[name] = resourceHeadroom
+			}
+		}
 	}
 
-	oneRPSCostCPU := float64(fullChainCPU) / float64(adjustedRPS)
-	oneRPSCostMemory := float64(fullChainMemory) / float64(adjustedRPS)
+	return headroom
+}
 
-	return oneRPSCostCPU, oneRPSCostMemory
+func nodesOverlap(nodes, otherNodes map[string]bool) bool {
+	for node := range nodes {
+		if otherNodes[node] {
+			return true
+		}
+	}
+	return false
 }
 
-// Calculate how many additional pods can the cluster handle, based on CPU and Memory occupied by all pod's dependencies
-func calculateClusterCanHandlePods(freeCPU, freeMemory, fullChainCPU, fullChainMemory int64, podsAmount int) int64 {
-	var clusterCanHandlePods int64
+// Calculate how many additional pods can the cluster handle, based on resources occupied by all pod's dependencies
+// and free pod slots of the nodes
+// This is an aggregate estimate, it ignores fragmentation of free resources between nodes
+func calculateClusterCanHandlePods(free, fullChain resourcesType, podsAmount int) int64 {
+	var clusterCanHandlePods int64 = -1
 
 	if podsAmount == 0 {
-		clusterCanHandlePods = 0
-	} else {
-		fullChainCPUPerPod := fullChainCPU / int64(podsAmount)
-		clusterCanHandlePodsCPU := freeCPU / fullChainCPUPerPod
+		return 0
+	}
 
-		fullChainMemoryPerPod := fullChainMemory / int64(podsAmount)
-		clusterCanHandlePodsMemory := freeMemory / fullChainMemoryPerPod
+	for name, fullChainValue := range fullChain {
+		fullChainPerPod := fullChainValue / int64(podsAmount)
 
-		if clusterCanHandlePodsCPU <= clusterCanHandlePodsMemory {
-			clusterCanHandlePods = clusterCanHandlePodsCPU
-		} else {
-			clusterCanHandlePods = clusterCanHandlePodsMemory
+		// Resource which is not requested does not limit anything
+		if fullChainPerPod == 0 {
+			continue
 		}
 
+		clusterCanHandlePodsResource := free[name] / fullChainPerPod
+		if clusterCanHandlePods == -1 || clusterCanHandlePodsResource < clusterCanHandlePods {
+			clusterCanHandlePods = clusterCanHandlePodsResource
+		}
+	}
+
+	// Pod without any resources would fit infinitely
+	if clusterCanHandlePods == -1 {
+		return 0
+	}
+
+	if free[v1.ResourcePods] < clusterCanHandlePods {
+		clusterCanHandlePods = free[v1.ResourcePods]
 	}
 
 	return clusterCanHandlePods
 }
 
+// Place whole pods node by node, honouring free resources and pod slots of every node
+// Every pod needs its share of the full chain resources
+// The constraint (resource or "pods" for pod slots) which alone allows to place the least pods is returned as the limiting one
+func simulatePodPlacement(nodes []nodeFreeResourcesType, fullChain resourcesType, podsAmount int) (int64, v1.ResourceName) {
+	var limitingResource v1.ResourceName
+	var limitingResourcePods int64 = -1
+
+	if podsAmount == 0 {
+		return 0, ""
+	}
+
+	pod := divideResources(fullChain, int64(podsAmount))
+
+	for name, value := range pod {
+		if value == 0 {
+			continue
+		}
+
+		resourcePods := placePods(nodes, resourcesType{name: value})
+		if limitingResourcePods == -1 || resourcePods < limitingResourcePods {
+			limitingResource = name
+			limitingResourcePods = resourcePods
+		}
+	}
+
+	// Pod without any resources would fit infinitely
+	if limitingResourcePods == -1 {
+		return 0, ""
+	}
+
+	// Placement of every resource is capped by pod slots too, so slots limit when they alone allow no more pods
+	if placePods(nodes, resourcesType{}) <= limitingResourcePods {
+		limitingResource = v1.ResourcePods
+	}
+
+	return placePods(nodes, pod), limitingResource
+}
+
+// Count how many pods with the specified resources fit on the nodes
+func placePods(nodes []nodeFreeResourcesType, pod resourcesType) int64 {
+	var placedPods int64
+
+	for _, node := range nodes {
+		nodeCanHandlePods := node.Pods
+
+		for name, value := range pod {
+			if value > 0 && node.Resources[name]/value < nodeCanHandlePods {
+				nodeCanHandlePods = node.Resources[name] / value
+			}
+		}
+
+		if nodeCanHandlePods > 0 {
+			logCalc.Debug("pods placed on node", "node", node.Name, "pods", nodeCanHandlePods, "podResources", pod)
+			placedPods += nodeCanHandlePods
+		}
+	}
+
+	return placedPods
+}
+
 // Calculate resource summary of the namespace and its dependents (applying ingressMultiplier)
-func calculateFullChainResources(config *configType, namespace string, cpu, mem map[string]int64, ingressMultipliers map[string]float64) (int64, int64) {
-	var cpuSum, memSum int64
+func calculateFullChainResources(config *configType, namespace string, resources map[string]resourcesType, ingressMultipliers map[string]float64) resourcesType {
+	sum := make(resourcesType)
 
-	printDebug("Main Namespace, CPU: %+v, Mem: %+v\n", cpu[namespace], mem[namespace])
+	logCalc.Debug("main namespace", "namespace", namespace, "resources", resources[namespace])
 
 	for _, currentNamespace := range config.Namespaces {
 		if currentNamespace.Name == namespace {
 			for _, dependantNamespace := range currentNamespace.DependsOnFullChain {
-				printDebug("Dependant Namespace: %+v, CPU: %+v, Mem: %+v\n", dependantNamespace, cpu[dependantNamespace], mem[dependantNamespace])
-				cpuSum += cpu[dependantNamespace]
-				memSum += mem[dependantNamespace]
+				logCalc.Debug("dependant namespace", "namespace", dependantNamespace, "resources", resources[dependantNamespace])
+				addResources(sum, resources[dependantNamespace])
 			}
 		}
 	}
@@ -58,38 +244,36 @@ func calculateFullChainResources(config *configType, namespace string, cpu, mem
 	// We add only a percent of shared resources...
 	multiplier, multiplierExists := ingressMultipliers[namespace]
 	if multiplierExists {
-		printDebug("Ingress Multiplier: %+v\n", multiplier)
-		cpuSum = int64(float64(cpuSum) * multiplier)
-		memSum = int64(float64(memSum) * multiplier)
+		logCalc.Debug("ingress multiplier", "namespace", namespace, "multiplier", multiplier)
+		for name, value := range sum {
+			sum[name] = int64(float64(value) * multiplier)
+		}
 	}
 
 	// ...and 100% of frontend resource
-	cpuSum += cpu[namespace]
-	memSum += mem[namespace]
+	addResources(sum, resources[namespace])
 
-	return cpuSum, memSum
+	return sum
 }
 
-// Return the biggest of used and requested CPU and Mem
-func calculateReallyOccupiedResources(usedCPU, usedMem, requestedCPU, requestedMem int64) (int64, int64) {
-	var reallyOccupiedCPU, reallyOccupiedMem int64
+// Return the biggest of used and requested value of every resource
+func calculateReallyOccupiedResources(used, requested resourcesType) resourcesType {
+	reallyOccupied := make(resourcesType)
 
-	if usedCPU >= requestedCPU {
-		reallyOccupiedCPU = usedCPU
-	} else {
-		reallyOccupiedCPU = requestedCPU
+	for name, usedValue := range used {
+		reallyOccupied[name] = usedValue
 	}
 
-	if usedMem >= requestedMem {
-		reallyOccupiedMem = usedMem
-	} else {
-		reallyOccupiedMem = requestedMem
+	for name, requestedValue := range requested {
+		if requestedValue > reallyOccupied[name] {
+			reallyOccupied[name] = requestedValue
+		}
 	}
 
-	return reallyOccupiedCPU, reallyOccupiedMem
+	return reallyOccupied
 }
 
-// Calculate ratio between every ingress' RPS and total RPS
+// Calculate ratio between every ingress' RPS and total RPS, no ratios if total RPS is 0
 func calculateIngressMultipliers(config *configType, adjustedRPS map[string]int64) map[string]float64 {
 	var RPSSum int64
 	ingressMultiplier := make(map[string]float64)
@@ -100,7 +284,12 @@ func calculateIngressMultipliers(config *configType, adjustedRPS map[string]int6
 		}
 	}
 
-	printDebug("RPSSum: %+v\n", RPSSum)
+	logCalc.Debug("frontend RPS sum", "rps", RPSSum)
+
+	// Without frontend traffic there is no ratio, dependencies are counted in full
+	if RPSSum == 0 {
+		return ingressMultiplier
+	}
 
 	for _, currentNamespace := range config.Namespaces {
 		if currentNamespace.Frontend {
@@ -127,7 +316,7 @@ func adjustRPS(config *configType, targetNamespace string, rawRPS int64) int64 {
 		}
 	}
 
-	printDebug("Multiplier: %+v\n", multiplier)
+	logCalc.Debug("RPS multiplier", "namespace", targetNamespace, "multiplier", multiplier)
 
 	adjustedRPS := math.Round(float64(rawRPS) * multiplier)
 	return int64(adjustedRPS)
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Parse the config and gather dependencies without the rest of validation
+func newTestConfig(t *testing.T, configData string) *configType {
+	t.Helper()
+
+	config := &configType{}
+	err := yaml.Unmarshal([]byte(configData), config)
+	if err != nil {
+		t.Fatalf("cannot parse test config: %v", err)
+	}
+
+	for nsNum, namespace := range config.Namespaces {
+		config.Namespaces[nsNum].DependsOnFullChain, err = getDependencies(config, namespace.Name)
+		if err != nil {
+			t.Fatalf("cannot gather dependencies of %s: %v", namespace.Name, err)
+		}
+	}
+
+	return config
+}
+
+func TestPlacePods(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []nodeFreeResourcesType
+		pod   resourcesType
+		want  int64
+	}{
+		{
+			name:  "no nodes",
+			nodes: nil,
+			pod:   resourcesType{v1.ResourceCPU: 100},
+			want:  0,
+		},
+		{
+			name: "whole pods per node",
+			nodes: []nodeFreeResourcesType{
+				{Name: "a", Resources: resourcesType{v1.ResourceCPU: 250}, Pods: 10},
+				{Name: "b", Resources: resourcesType{v1.ResourceCPU: 199}, Pods: 10},
+			},
+			pod:  resourcesType{v1.ResourceCPU: 100},
+			want: 3,
+		},
+		{
+			name: "fragmented nodes fit nothing",
+			nodes: []nodeFreeResourcesType{
+				{Name: "a", Resources: resourcesType{v1.ResourceCPU: 500, v1.ResourceMemory: 100}, Pods: 10},
+				{Name: "b", Resources: resourcesType{v1.ResourceCPU: 100, v1.ResourceMemory: 500}, Pods: 10},
+			},
+			pod:  resourcesType{v1.ResourceCPU: 200, v1.ResourceMemory: 200},
+			want: 0,
+		},
+		{
+			name: "pod slots limit",
+			nodes: []nodeFreeResourcesType{
+				{Name: "a", Resources: resourcesType{v1.ResourceCPU: 1000}, Pods: 2},
+			},
+			pod:  resourcesType{v1.ResourceCPU: 100},
+			want: 2,
+		},
+		{
+			name: "negative free resources",
+			nodes: []nodeFreeResourcesType{
+				{Name: "a", Resources: resourcesType{v1.ResourceCPU: -300}, Pods: 10},
+				{Name: "b", Resources: resourcesType{v1.ResourceCPU: 100}, Pods: 10},
+			},
+			pod:  resourcesType{v1.ResourceCPU: 100},
+			want: 1,
+		},
+		{
+			name: "pod without resources takes slots only",
+			nodes: []nodeFreeResourcesType{
+				{Name: "a", Resources: resourcesType{v1.ResourceCPU: 0}, Pods: 3},
+				{Name: "b", Resources: resourcesType{v1.ResourceCPU: 0}, Pods: 4},
+			},
+			pod:  resourcesType{},
+			want: 7,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := placePods(test.nodes, test.pod)
+			if got != test.want {
+				t.Errorf("placePods() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSimulatePodPlacement(t *testing.T) {
+	tests := []struct {
+		name         string
+		nodes        []nodeFreeResourcesType
+		fullChain    resourcesType
+		podsAmount   int
+		wantPods     int64
+		wantLimiting v1.ResourceName
+	}{
+		{
+			name:       "no pods",
+			nodes:      []nodeFreeResourcesType{{Name: "a", Resources: resourcesType{v1.ResourceCPU: 1000}, Pods: 10}},
+			fullChain:  resourcesType{v1.ResourceCPU: 200},
+			podsAmount: 0,
+		},
+		{
+			name:       "pod without resources",
+			nodes:      []nodeFreeResourcesType{{Name: "a", Resources: resourcesType{v1.ResourceCPU: 1000}, Pods: 10}},
+			fullChain:  resourcesType{v1.ResourceCPU: 0},
+			podsAmount: 2,
+		},
+		{
+			name: "limited by cpu",
+			nodes: []nodeFreeResourcesType{
+				{Name: "a", Resources: resourcesType{v1.ResourceCPU: 1000, v1.ResourceMemory: 10000}, Pods: 10},
+			},
+			fullChain:    resourcesType{v1.ResourceCPU: 400, v1.ResourceMemory: 2000},
+			podsAmount:   2,
+			wantPods:     5,
+			wantLimiting: v1.ResourceCPU,
+		},
+		{
+			name: "limited by pod slots",
+			nodes: []nodeFreeResourcesType{
+				{Name: "a", Resources: resourcesType{v1.ResourceCPU: 1000, v1.ResourceMemory: 10000}, Pods: 1},
+			},
+			fullChain:    resourcesType{v1.ResourceCPU: 100, v1.ResourceMemory: 100},
+			podsAmount:   1,
+			wantPods:     1,
+			wantLimiting: v1.ResourcePods,
+		},
+		{
+			name: "fragmentation places fewer pods than either resource alone",
+			nodes: []nodeFreeResourcesType{
+				{Name: "a", Resources: resourcesType{v1.ResourceCPU: 400, v1.ResourceMemory: 100}, Pods: 10},
+				{Name: "b", Resources: resourcesType{v1.ResourceCPU: 200, v1.ResourceMemory: 400}, Pods: 10},
+			},
+			fullChain:    resourcesType{v1.ResourceCPU: 100, v1.ResourceMemory: 100},
+			podsAmount:   1,
+			wantPods:     3,
+			wantLimiting: v1.ResourceMemory,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotPods, gotLimiting := simulatePodPlacement(test.nodes, test.fullChain, test.podsAmount)
+			if gotPods != test.wantPods || gotLimiting != test.wantLimiting {
+				t.Errorf("simulatePodPlacement() = %d, %q, want %d, %q", gotPods, gotLimiting, test.wantPods, test.wantLimiting)
+			}
+		})
+	}
+}
+
+func TestCalculateIngressMultipliers(t *testing.T) {
+	config := newTestConfig(t, `
+namespaces:
+  - name: web
+    frontend: true
+  - name: api
+    frontend: true
+  - name: db
+`)
+
+	multipliers := calculateIngressMultipliers(config, map[string]int64{"web": 300, "api": 100, "db": 1000})
+	if multipliers["web"] != 0.75 || multipliers["api"] != 0.25 || len(multipliers) != 2 {
+		t.Errorf("calculateIngressMultipliers() = %v, want web 0.75 and api 0.25", multipliers)
+	}
+
+	multipliers = calculateIngressMultipliers(config, map[string]int64{"web": 0, "api": 0, "db": 1000})
+	if len(multipliers) != 0 {
+		t.Errorf("calculateIngressMultipliers() without frontend traffic = %v, want no multipliers", multipliers)
+	}
+}
+
+func TestCalculateRPSHeadroom(t *testing.T) {
+	config := newTestConfig(t, `
+namespaces:
+  - name: front
+    frontend: true
+    depends_on: [back]
+  - name: back
+`)
+
+	newAppCapacity := func(free int64, nodeNames ...string) *appCapacityType {
+		appCapacity := &appCapacityType{
+			AdjustedRPS:    100,
+			Pods:           1,
+			ReallyOccupied: resourcesType{v1.ResourceCPU: 1000},
+			Free:           resourcesType{v1.ResourceCPU: free, v1.ResourcePods: 200},
+		}
+		for _, nodeName := range nodeNames {
+			appCapacity.Nodes = append(appCapacity.Nodes, nodeFreeResourcesType{Name: nodeName, Counted: true})
+		}
+		return appCapacity
+	}
+
+	tests := []struct {
+		name          string
+		appCapacities map[string]*appCapacityType
+		wantRPS       float64
+		wantNamespace string
+	}{
+		{
+			name: "shared nodes pay for the whole chain",
+			appCapacities: map[string]*appCapacityType{
+				"front": newAppCapacity(6000, "a", "b"),
+				"back":  newAppCapacity(6000, "a", "b"),
+			},
+			wantRPS:       300,
+			wantNamespace: "front",
+		},
+		{
+			name: "separate nodes pay for their namespace only",
+			appCapacities: map[string]*appCapacityType{
+				"front": newAppCapacity(4000, "a"),
+				"back":  newAppCapacity(3000, "b"),
+			},
+			wantRPS:       300,
+			wantNamespace: "back",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headroom := calculateRPSHeadroom(config, "front", test.appCapacities, map[string]float64{"front": 1})
+			if headroom == nil {
+				t.Fatalf("calculateRPSHeadroom() = nil")
+			}
+			if headroom.RPS != test.wantRPS || headroom.Namespace != test.wantNamespace || headroom.Resource != v1.ResourceCPU {
+				t.Errorf("calculateRPSHeadroom() = %v of %s %s, want %v of %s cpu", headroom.RPS, headroom.Namespace, headroom.Resource, test.wantRPS, test.wantNamespace)
+			}
+			if headroom.ByResource[v1.ResourceCPU] != test.wantRPS {
+				t.Errorf("cpu headroom = %v, want %v", headroom.ByResource[v1.ResourceCPU], test.wantRPS)
+			}
+		})
+	}
+
+	noRPS := map[string]*appCapacityType{"front": {}, "back": {}}
+	if headroom := calculateRPSHeadroom(config, "front", noRPS, nil); headroom != nil {
+		t.Errorf("calculateRPSHeadroom() without RPS = %v, want nil", headroom)
+	}
+}
+
+func TestAggregateRPS(t *testing.T) {
+	values := []float64{7, 3, 10, 1, 5, 9, 2, 8, 4, 6}
+
+	tests := []struct {
+		name        string
+		values      []float64
+		aggregation string
+		want        float64
+		wantErr     bool
+	}{
+		{name: "max", values: values, aggregation: "max", want: 10},
+		{name: "avg", values: values, aggregation: "avg", want: 5.5},
+		{name: "median is the nearest rank", values: values, aggregation: "p50", want: 5},
+		{name: "rank is rounded up", values: values, aggregation: "p91", want: 10},
+		{name: "fractional percentile", values: values, aggregation: "p99.5", want: 10},
+		{name: "p100 is max", values: values, aggregation: "p100", want: 10},
+		{name: "small percentile takes the first value", values: values, aggregation: "p1", want: 1},
+		{name: "single value", values: []float64{42}, aggregation: "p95", want: 42},
+		{name: "no values", values: nil, aggregation: "p95", want: 0},
+		{name: "p0", values: values, aggregation: "p0", wantErr: true},
+		{name: "above p100", values: values, aggregation: "p100.1", wantErr: true},
+		{name: "percentile without p", values: values, aggregation: "99", wantErr: true},
+		{name: "not a number", values: values, aggregation: "pmax", wantErr: true},
+		{name: "unknown aggregation", values: values, aggregation: "median", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := aggregateRPS(test.values, test.aggregation)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("aggregateRPS() error = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("aggregateRPS() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRPSPercentile(t *testing.T) {
+	tests := []struct {
+		aggregation string
+		want        float64
+		wantErr     bool
+	}{
+		{aggregation: "p99", want: 99},
+		{aggregation: "p99.5", want: 99.5},
+		{aggregation: "p100", want: 100},
+		{aggregation: "p0", wantErr: true},
+		{aggregation: "p-5", wantErr: true},
+		{aggregation: "99", wantErr: true},
+		{aggregation: "p", wantErr: true},
+		{aggregation: "max", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.aggregation, func(t *testing.T) {
+			got, err := parseRPSPercentile(test.aggregation)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseRPSPercentile() error = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("parseRPSPercentile() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const capacityAPIPath = "/api/v1/capacity"
+
+// Everything calculated during one collection cycle
+type capacitySnapshotType struct {
+	Time time.Time `json:"time"`
+
+	// False if the cluster state could not be collected and nothing was calculated
+	Complete bool `json:"complete"`
+
+	IngressMultipliers map[string]float64               `json:"ingress_multipliers"`
+	NodePools          map[string]nodePoolResourcesType `json:"node_pools"`
+	Apps               []*appCapacityType               `json:"apps"`
+}
+
+type appCapacityType struct {
+	App   string `json:"app"`
+	Error string `json:"error,omitempty"`
+
+	WorkloadKind string `json:"workload_kind"`
+	WorkloadName string `json:"workload_name"`
+	Pods         int    `json:"pods"`
+
+	RawRPS             int64    `json:"rps_raw"`
+	PeakRPS            int64    `json:"rps_peak"`
+	AdjustedRPS        int64    `json:"rps_adjusted"`
+	DependsOnFullChain []string `json:"depends_on_full_chain"`
+	IngressMultiplier  *float64 `json:"ingress_multiplier,omitempty"`
+
+	Requested      resourcesType `json:"requested"`
+	Used           resourcesType `json:"used"`
+	ReallyOccupied resourcesType `json:"really_occupied"`
+	Free           resourcesType `json:"free"`
+	Allocatable    resourcesType `json:"allocatable"`
+	FullChain      resourcesType `json:"full_chain"`
+
+	OneRPSCost map[v1.ResourceName]float64 `json:"rps_cost"`
+
+	ClusterCanHandleAdditionalPods          int64           `json:"cluster_can_handle_additional_pods"`
+	ClusterCanHandleAdditionalPodsAggregate int64           `json:"cluster_can_handle_additional_pods_aggregate"`
+	LimitingResource                        v1.ResourceName `json:"limiting_resource,omitempty"`
+
+	// Absent when the app has no RPS
+	RPSHeadroom           *int64                      `json:"rps_headroom,omitempty"`
+	MaxRPS                *int64                      `json:"max_rps,omitempty"`
+	RPSHeadroomNamespace  string                      `json:"rps_headroom_limited_by_namespace,omitempty"`
+	RPSHeadroomResource   v1.ResourceName             `json:"rps_headroom_limited_by_resource,omitempty"`
+	RPSHeadroomByResource map[v1.ResourceName]float64 `json:"rps_headroom_by_resource,omitempty"`
+
+	Forecast *forecastType `json:"forecast,omitempty"`
+
+	Nodes         []nodeFreeResourcesType `json:"nodes"`
+	ExcludedNodes map[string]string       `json:"excluded_nodes"`
+}
+
+// The latest snapshot served by the capacity API
+var latestSnapshot atomic.Pointer[capacitySnapshotType]
+
+// Collect the cluster state and RPS and calculate capacity of every app
+// Apps whose inputs failed are returned with the error and without calculated values
+func runCollectionCycle(config *configType) *capacitySnapshotType {
+	snapshot := &capacitySnapshotType{Time: time.Now()}
+	appErrors := make(map[string]error)
+	appCapacities := make(map[string]*appCapacityType)
+	reallyOccupied := make(map[string]resourcesType)
+	adjustedRPS := make(map[string]int64)
+
+	for _, app := range getAllNamespaces(config) {
+		appCapacities[app] = &appCapacityType{App: app}
+		snapshot.Apps = append(snapshot.Apps, appCapacities[app])
+	}
+
+	nodeList, err := getNodeList()
+	if err != nil {
+		failAllApps(config, appErrors, "kubernetes", err)
+	}
+
+	podList, err := getPodList()
+	if err != nil {
+		failAllApps(config, appErrors, "kubernetes", err)
+	}
+
+	podMetricsList, usageSource, err := getUsageMetricsList(config)
+	if err != nil {
+		failAllApps(config, appErrors, usageSource, err)
+	}
+
+	// Nothing can be calculated without the cluster state
+	if len(appErrors) > 0 {
+		setAppErrors(snapshot, appErrors)
+		return snapshot
+	}
+	snapshot.Complete = true
+
+	snapshot.NodePools = getNodePoolResources(config, &nodeList)
+
+	for _, namespace := range config.Namespaces {
+		nsName := namespace.Name
+		appCapacity := appCapacities[nsName]
+
+		workload, err := getWorkload(nsName, getWorkloadKind(config, nsName), getDeploymentName(config, nsName))
+		if err != nil {
+			failApp(appErrors, nsName, "kubernetes", err)
+			continue
+		}
+		appCapacity.WorkloadKind = workload.Kind
+		appCapacity.WorkloadName = workload.Name
+
+		logK8s.Debug("workload", "namespace", nsName, "kind", workload.Kind, "name", workload.Name, "replicas", workload.Replicas)
+
+		appCapacity.Requested = getWorkloadRequestedResources(config, &workload)
+		logK8s.Debug("workload requested resources", "namespace", nsName, "resources", appCapacity.Requested)
+
+		workloadPodList, err := getWorkloadPods(&workload, &podList)
+		if err != nil {
+			failApp(appErrors, nsName, "kubernetes", err)
+			continue
+		}
+		appCapacity.Pods = len(workloadPodList.Items)
+		logK8s.Debug("amount of pods", "namespace", nsName, "pods", appCapacity.Pods)
+
+		appCapacity.Used = getUsedResources(config, &podMetricsList, &workloadPodList)
+		logK8s.Debug("used resources", "namespace", nsName, "resources", appCapacity.Used)
+
+		appCapacity.ReallyOccupied = calculateReallyOccupiedResources(appCapacity.Used, appCapacity.Requested)
+		reallyOccupied[nsName] = appCapacity.ReallyOccupied
+		logCalc.Debug("really occupied resources", "namespace", nsName, "resources", appCapacity.ReallyOccupied)
+
+		appCapacity.Free, appCapacity.Allocatable, appCapacity.Nodes, appCapacity.ExcludedNodes = getFreeResources(config, &workload, &nodeList, &podList, &podMetricsList, appCapacity.ReallyOccupied, appCapacity.Pods)
+		logCalc.Debug("free resources", "namespace", nsName, "resources", appCapacity.Free, "allowedNodes", len(appCapacity.Nodes))
+
+		appCapacity.DependsOnFullChain = namespace.DependsOnFullChain
+		logCalc.Debug("dependencies", "namespace", nsName, "dependencies", appCapacity.DependsOnFullChain)
+
+		appCapacity.RawRPS, err = getRPS(config, nsName)
+		if err != nil {
+			failApp(appErrors, nsName, "prometheus", err)
+			continue
+		}
+		logProm.Debug("raw RPS", "namespace", nsName, "rps", appCapacity.RawRPS)
+
+		// Capacity is calculated for the peak in range mode, peak is the raw RPS in instant mode
+		appCapacity.PeakRPS = appCapacity.RawRPS
+		if getRPSMode(config) == rpsModeRange {
+			appCapacity.PeakRPS, err = getPeakRPS(config, nsName)
+			if err != nil {
+				failApp(appErrors, nsName, "prometheus", err)
+				continue
+			}
+		}
+
+		appCapacity.AdjustedRPS = adjustRPS(config, nsName, appCapacity.PeakRPS)
+		adjustedRPS[nsName] = appCapacity.AdjustedRPS
+		logCalc.Debug("adjusted RPS", "namespace", nsName, "rps", appCapacity.AdjustedRPS)
+	}
+
+	snapshot.IngressMultipliers = calculateIngressMultipliers(config, adjustedRPS)
+	logCalc.Debug("ingress multipliers", "multipliers", snapshot.IngressMultipliers)
+
+	for _, namespace := range config.Namespaces {
+		nsName := namespace.Name
+		appCapacity := appCapacities[nsName]
+
+		// Full chain of the app (and ingress multipliers for frontends) is wrong if any of its inputs failed
+		if inputsFailed(config, appErrors, nsName) {
+			continue
+		}
+
+		multiplier, multiplierExists := snapshot.IngressMultipliers[nsName]
+		if multiplierExists {
+			appCapacity.IngressMultiplier = &multiplier
+		}
+
+		appCapacity.FullChain = calculateFullChainResources(config, nsName, reallyOccupied, snapshot.IngressMultipliers)
+		logCalc.Debug("full chain resources", "namespace", nsName, "resources", appCapacity.FullChain)
+
+		appCapacity.ClusterCanHandleAdditionalPods, appCapacity.LimitingResource = simulatePodPlacement(appCapacity.Nodes, appCapacity.FullChain, appCapacity.Pods)
+		appCapacity.ClusterCanHandleAdditionalPodsAggregate = calculateClusterCanHandlePods(appCapacity.Free, appCapacity.FullChain, appCapacity.Pods)
+		logCalc.Debug("cluster can handle additional pods", "namespace", nsName, "pods", appCapacity.ClusterCanHandleAdditionalPods, "aggregatePods", appCapacity.ClusterCanHandleAdditionalPodsAggregate, "limitingResource", appCapacity.LimitingResource)
+
+		appCapacity.OneRPSCost = calculateOneRPSCost(appCapacity.FullChain, appCapacity.AdjustedRPS)
+		logCalc.Debug("one RPS cost", "namespace", nsName, "resources", appCapacity.OneRPSCost)
+
+		headroom := calculateRPSHeadroom(config, nsName, appCapacities, snapshot.IngressMultipliers)
+		if headroom != nil {
+			rpsHeadroom := int64(math.Floor(headroom.RPS))
+			maxRPS := appCapacity.AdjustedRPS + rpsHeadroom
+
+			appCapacity.RPSHeadroom = &rpsHeadroom
+			appCapacity.MaxRPS = &maxRPS
+			appCapacity.RPSHeadroomNamespace = headroom.Namespace
+			appCapacity.RPSHeadroomResource = headroom.Resource
+			appCapacity.RPSHeadroomByResource = headroom.ByResource
+		}
+		logCalc.Debug("RPS headroom", "namespace", nsName, "headroom", appCapacity.RPSHeadroom, "limitingNamespace", appCapacity.RPSHeadroomNamespace, "limitingResource", appCapacity.RPSHeadroomResource)
+
+		// Forecast is optional, its failure does not fail the app
+		if config.Forecast.Enabled {
+			appCapacity.Forecast = forecastApp(config, appCapacity)
+			if appCapacity.Forecast.Error != "" {
+				logCalc.Warn("cannot forecast", "namespace", nsName, "err", appCapacity.Forecast.Error)
+				metricScrapeErrors.WithLabelValues(nsName, "forecast").Inc()
+			}
+		}
+	}
+
+	setAppErrors(snapshot, appErrors)
+	return snapshot
+}
+
+func setAppErrors(snapshot *capacitySnapshotType, appErrors map[string]error) {
+	for _, appCapacity := range snapshot.Apps {
+		if err, failed := appErrors[appCapacity.App]; failed {
+			appCapacity.Error = err.Error()
+		}
+	}
+}
+
+// Get errors of the snapshot's apps
+func (snapshot *capacitySnapshotType) getAppErrors() map[string]string {
+	appErrors := make(map[string]string)
+
+	for _, appCapacity := range snapshot.Apps {
+		if appCapacity.Error != "" {
+			appErrors[appCapacity.App] = appCapacity.Error
+		}
+	}
+
+	return appErrors
+}
+
+func (snapshot *capacitySnapshotType) getApp(app string) *appCapacityType {
+	for _, appCapacity := range snapshot.Apps {
+		if appCapacity.App == app {
+			return appCapacity
+		}
+	}
+	return nil
+}
+
+// Serve the latest snapshot: /api/v1/capacity for all apps and /api/v1/capacity/<app> for one app
+func capacityAPIHandler(writer http.ResponseWriter, request *http.Request) {
+	snapshot := latestSnapshot.Load()
+	if snapshot == nil {
+		writeJSON(writer, http.StatusServiceUnavailable, map[string]string{"error": "first collection cycle is not finished yet"})
+		return
+	}
+
+	app := strings.Trim(strings.TrimPrefix(request.URL.Path, capacityAPIPath), "/")
+	if app == "" {
+		writeJSON(writer, http.StatusOK, snapshot)
+		return
+	}
+
+	appCapacity := snapshot.getApp(app)
+	if appCapacity == nil {
+		writeJSON(writer, http.StatusNotFound, map[string]string{"error": "unknown app " + app})
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, appCapacity)
+}
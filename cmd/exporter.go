@@ -2,12 +2,252 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	v1 "k8s.io/api/core/v1"
 )
 
+var (
+	metricScrapeErrors        *prometheus.CounterVec
+	metricLastSuccessfulCycle prometheus.Gauge
+	metricConfigReloads       *prometheus.CounterVec
+	metricNodeExcluded        *prometheus.GaugeVec
+
+	metricNodePoolAllocatableCPU    *prometheus.GaugeVec
+	metricNodePoolAllocatableMemory *prometheus.GaugeVec
+	metricNodePoolCapacityCPU       *prometheus.GaugeVec
+	metricNodePoolCapacityMemory    *prometheus.GaugeVec
+
+	metricFree             *prometheus.GaugeVec
+	metricAllocatable      *prometheus.GaugeVec
+	metricRPSCost          *prometheus.GaugeVec
+	metricLimitingResource *prometheus.GaugeVec
+
+	metricRPSHeadroom *prometheus.GaugeVec
+	metricMaxRPS      *prometheus.GaugeVec
+
+	metricDaysUntilExhaustion *prometheus.GaugeVec
+	metricForecastPeakRPS     *prometheus.GaugeVec
+
+	appMetrics = make(map[string]*appMetricsType)
+)
+
+// Gauges labeled with the app name
+type appMetricsType struct {
+	RPSCostCPU                              prometheus.Gauge
+	RPSCostMemory                           prometheus.Gauge
+	PodAmount                               prometheus.Gauge
+	ClusterCanHandleAdditionalPods          prometheus.Gauge
+	ClusterCanHandleAdditionalPodsAggregate prometheus.Gauge
+	RawRPS                                  prometheus.Gauge
+	PeakRPS                                 prometheus.Gauge
+	AdjustedRPS                             prometheus.Gauge
+	FreeCPU                                 prometheus.Gauge
+	FreeMemory                              prometheus.Gauge
+	AllocatableCPU                          prometheus.Gauge
+	AllocatableMemory                       prometheus.Gauge
+}
+
+// Create and register all Prometheus metrics
+func createMetrics(config *configType) {
+	metricScrapeErrors = createCounterVec("scrape_errors_total", "How many times the app's inputs could not be collected", []string{"app", "source"})
+	metricNodeExcluded = createGaugeVec("node_excluded", "Node is not counted for the app, with the reason (unschedulable, not_ready, affinity, taint)", []string{"app", "node", "reason"})
+	metricNodePoolAllocatableCPU = createGaugeVec("node_pool_allocatable_cpu", "Total allocatable MilliCPUs of the node pool", []string{"pool"})
+	metricNodePoolAllocatableMemory = createGaugeVec("node_pool_allocatable_mem", "Total allocatable Memory bytes of the node pool", []string{"pool"})
+	metricNodePoolCapacityCPU = createGaugeVec("node_pool_capacity_cpu", "Total MilliCPUs capacity of the node pool (including reserved)", []string{"pool"})
+	metricNodePoolCapacityMemory = createGaugeVec("node_pool_capacity_mem", "Total Memory bytes capacity of the node pool (including reserved)", []string{"pool"})
+	metricFree = createGaugeVec("free", "Amount of the resource available for the app (MilliCPUs for cpu, pod slots for pods)", []string{"app", "resource"})
+	metricAllocatable = createGaugeVec("allocatable", "Total allocatable amount of the resource for the app (MilliCPUs for cpu, pod slots for pods)", []string{"app", "resource"})
+	metricRPSCost = createGaugeVec("rps_cost", "How much of the resource costs one RPS (MilliCPUs for cpu)", []string{"app", "resource"})
+	metricLimitingResource = createGaugeVec("cluster_can_handle_additional_pods_limited_by", "The constraint (resource or pods) which limits the amount of additional pods", []string{"app", "resource"})
+	metricRPSHeadroom = createGaugeVec("rps_headroom", "How many additional RPS the app can take before it or one of its dependencies runs out of free resources", []string{"app"})
+	metricMaxRPS = createGaugeVec("max_rps", "Adjusted RPS plus RPS headroom", []string{"app"})
+	metricDaysUntilExhaustion = createGaugeVec("days_until_exhaustion", "In how many days projected RPS outgrows the free resource (+Inf if not within forecast.horizon_days)", []string{"app", "resource"})
+	metricForecastPeakRPS = createGaugeVec("forecast_rps_peak", "Projected peak of adjusted RPS within forecast.horizon_days", []string{"app"})
+	metricLastSuccessfulCycle = createGauge("last_successful_cycle_timestamp_seconds", "Unix time of the last collection cycle without errors", nil)
+	metricConfigReloads = createCounterVec("config_reloads_total", "How many times the config was reloaded, by result (success, failure)", []string{"result"})
+
+	for _, app := range getAllNamespaces(config) {
+		appMetrics[app] = createAppMetrics(app)
+	}
+}
+
+func createAppMetrics(app string) *appMetricsType {
+	labels := map[string]string{"app": app}
+
+	return &appMetricsType{
+		RPSCostCPU:                              createGauge("rps_cost_cpu", "How many milliCPUs costs one RPS", labels),
+		RPSCostMemory:                           createGauge("rps_cost_mem", "How many Memory bytes costs one RPS", labels),
+		PodAmount:                               createGauge("pod_amount", "Current amount of pods", labels),
+		ClusterCanHandleAdditionalPods:          createGauge("cluster_can_handle_additional_pods", "How many additional pods can the current cluster handle (placing pods node by node)", labels),
+		ClusterCanHandleAdditionalPodsAggregate: createGauge("cluster_can_handle_additional_pods_aggregate", "How many additional pods can the current cluster handle (summing free resources of all nodes)", labels),
+		RawRPS:                                  createGauge("rps_raw", "Raw RPS from Prometheus", labels),
+		PeakRPS:                                 createGauge("rps_peak", "RPS aggregated over prometheus.rps_lookback in range mode (equals rps_raw in instant mode)", labels),
+		AdjustedRPS:                             createGauge("rps_adjusted", "Adjusted RPS with multipliers from config", labels),
+		FreeCPU:                                 createGauge("free_cpu", "MilliCPUs available for the app", labels),
+		FreeMemory:                              createGauge("free_mem", "Memory bytes available for the app", labels),
+		AllocatableCPU:                          createGauge("allocatable_cpu", "Total allocatable MilliCPUs for the app", labels),
+		AllocatableMemory:                       createGauge("allocatable_mem", "Total allocatable Memory bytes for the app", labels),
+	}
+}
+
+// Create metrics of added apps and remove metrics of apps which are not in the config anymore
+func updateAppMetrics(config *configType) {
+	apps := getAllNamespaces(config)
+
+	for _, app := range apps {
+		if _, exists := appMetrics[app]; !exists {
+			logMain.Info("app is added", "namespace", app)
+			appMetrics[app] = createAppMetrics(app)
+		}
+	}
+
+	for app, metrics := range appMetrics {
+		if inList(app, apps) {
+			continue
+		}
+		logMain.Info("app is removed", "namespace", app)
+
+		for _, collector := range metrics.collectors() {
+			prometheus.Unregister(collector)
+		}
+
+		for _, vec := range []*prometheus.MetricVec{metricScrapeErrors.MetricVec, metricNodeExcluded.MetricVec, metricFree.MetricVec, metricAllocatable.MetricVec, metricRPSCost.MetricVec, metricLimitingResource.MetricVec, metricRPSHeadroom.MetricVec, metricMaxRPS.MetricVec, metricDaysUntilExhaustion.MetricVec, metricForecastPeakRPS.MetricVec} {
+			vec.DeletePartialMatch(prometheus.Labels{"app": app})
+		}
+
+		delete(appMetrics, app)
+	}
+}
+
+// Forecast metrics are removed when forecasting is disabled and keep previous values when it fails
+func publishForecastMetrics(app string, forecast *forecastType) {
+	if forecast == nil {
+		metricDaysUntilExhaustion.DeletePartialMatch(prometheus.Labels{"app": app})
+		metricForecastPeakRPS.DeletePartialMatch(prometheus.Labels{"app": app})
+		return
+	}
+
+	if forecast.Error != "" {
+		return
+	}
+
+	metricDaysUntilExhaustion.DeletePartialMatch(prometheus.Labels{"app": app})
+	for resourceName := range forecast.MaxRPS {
+		daysUntilExhaustion, exhausted := forecast.DaysUntilExhaustion[resourceName]
+		if !exhausted {
+			daysUntilExhaustion = math.Inf(1)
+		}
+		metricDaysUntilExhaustion.WithLabelValues(app, string(resourceName)).Set(daysUntilExhaustion)
+	}
+
+	metricForecastPeakRPS.WithLabelValues(app).Set(float64(forecast.ProjectedPeakRPS))
+}
+
+func (metrics *appMetricsType) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		metrics.RPSCostCPU,
+		metrics.RPSCostMemory,
+		metrics.PodAmount,
+		metrics.ClusterCanHandleAdditionalPods,
+		metrics.ClusterCanHandleAdditionalPodsAggregate,
+		metrics.RawRPS,
+		metrics.PeakRPS,
+		metrics.AdjustedRPS,
+		metrics.FreeCPU,
+		metrics.FreeMemory,
+		metrics.AllocatableCPU,
+		metrics.AllocatableMemory,
+	}
+}
+
+// Set Prometheus metrics from the snapshot, metrics of failed apps keep their previous values
+func publishMetrics(config *configType, snapshot *capacitySnapshotType) {
+	if !snapshot.Complete {
+		return
+	}
+
+	// Node pools may disappear between cycles
+	metricNodePoolAllocatableCPU.Reset()
+	metricNodePoolAllocatableMemory.Reset()
+	metricNodePoolCapacityCPU.Reset()
+	metricNodePoolCapacityMemory.Reset()
+	for poolName, nodePool := range snapshot.NodePools {
+		logK8s.Debug("node pool resources", "pool", poolName, "allocatableMilliCPU", nodePool.AllocatableCPU, "allocatableMem", nodePool.AllocatableMemory, "capacityMilliCPU", nodePool.CapacityCPU, "capacityMem", nodePool.CapacityMemory)
+
+		metricNodePoolAllocatableCPU.WithLabelValues(poolName).Set(float64(nodePool.AllocatableCPU))
+		metricNodePoolAllocatableMemory.WithLabelValues(poolName).Set(float64(nodePool.AllocatableMemory))
+		metricNodePoolCapacityCPU.WithLabelValues(poolName).Set(float64(nodePool.CapacityCPU))
+		metricNodePoolCapacityMemory.WithLabelValues(poolName).Set(float64(nodePool.CapacityMemory))
+	}
+
+	for _, appCapacity := range snapshot.Apps {
+		app := appCapacity.App
+
+		// Excluded nodes may change between cycles
+		if appCapacity.ExcludedNodes != nil {
+			metricNodeExcluded.DeletePartialMatch(prometheus.Labels{"app": app})
+			for nodeName, reason := range appCapacity.ExcludedNodes {
+				metricNodeExcluded.WithLabelValues(app, nodeName, reason).Set(1)
+			}
+		}
+
+		if appCapacity.Error != "" {
+			logMain.Warn("skip publishing metrics", "namespace", app, "err", appCapacity.Error)
+			continue
+		}
+
+		metrics := appMetrics[app]
+		metrics.RPSCostCPU.Set(appCapacity.OneRPSCost[v1.ResourceCPU])
+		metrics.RPSCostMemory.Set(appCapacity.OneRPSCost[v1.ResourceMemory])
+		metrics.PodAmount.Set(float64(appCapacity.Pods))
+		metrics.ClusterCanHandleAdditionalPods.Set(float64(appCapacity.ClusterCanHandleAdditionalPods))
+		metrics.ClusterCanHandleAdditionalPodsAggregate.Set(float64(appCapacity.ClusterCanHandleAdditionalPodsAggregate))
+		metrics.RawRPS.Set(float64(appCapacity.RawRPS))
+		metrics.PeakRPS.Set(float64(appCapacity.PeakRPS))
+		metrics.AdjustedRPS.Set(float64(appCapacity.AdjustedRPS))
+		metrics.FreeCPU.Set(float64(appCapacity.Free[v1.ResourceCPU]))
+		metrics.FreeMemory.Set(float64(appCapacity.Free[v1.ResourceMemory]))
+		metrics.AllocatableCPU.Set(float64(appCapacity.Allocatable[v1.ResourceCPU]))
+		metrics.AllocatableMemory.Set(float64(appCapacity.Allocatable[v1.ResourceMemory]))
+
+		// Resources may be removed from the config on reload
+		for _, vec := range []*prometheus.GaugeVec{metricFree, metricAllocatable, metricRPSCost} {
+			vec.DeletePartialMatch(prometheus.Labels{"app": app})
+		}
+		for _, resourceName := range getConfiguredResources(config) {
+			metricFree.WithLabelValues(app, string(resourceName)).Set(float64(appCapacity.Free[resourceName]))
+			metricAllocatable.WithLabelValues(app, string(resourceName)).Set(float64(appCapacity.Allocatable[resourceName]))
+			metricRPSCost.WithLabelValues(app, string(resourceName)).Set(appCapacity.OneRPSCost[resourceName])
+		}
+		metricFree.WithLabelValues(app, string(v1.ResourcePods)).Set(float64(appCapacity.Free[v1.ResourcePods]))
+		metricAllocatable.WithLabelValues(app, string(v1.ResourcePods)).Set(float64(appCapacity.Allocatable[v1.ResourcePods]))
+
+		metricLimitingResource.DeletePartialMatch(prometheus.Labels{"app": app})
+		if appCapacity.LimitingResource != "" {
+			metricLimitingResource.WithLabelValues(app, string(appCapacity.LimitingResource)).Set(1)
+		}
+
+		// Headroom is unknown without RPS
+		if appCapacity.RPSHeadroom != nil {
+			metricRPSHeadroom.WithLabelValues(app).Set(float64(*appCapacity.RPSHeadroom))
+			metricMaxRPS.WithLabelValues(app).Set(float64(*appCapacity.MaxRPS))
+		} else {
+			metricRPSHeadroom.DeleteLabelValues(app)
+			metricMaxRPS.DeleteLabelValues(app)
+		}
+
+		publishForecastMetrics(app, appCapacity.Forecast)
+	}
+
+	if len(snapshot.getAppErrors()) == 0 {
+		metricLastSuccessfulCycle.SetToCurrentTime()
+	}
+}
+
 func serveExporter(config *configType) {
 	var host, address, endpoint string
 	var port int64
@@ -29,6 +269,12 @@ func serveExporter(config *configType) {
 	address = fmt.Sprintf("%s:%d", host, port)
 
 	http.Handle(endpoint, promhttp.Handler())
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/status", statusHandler)
+	http.HandleFunc(capacityAPIPath, capacityAPIHandler)
+	http.HandleFunc(capacityAPIPath+"/", capacityAPIHandler)
+
 	err := http.ListenAndServe(address, nil)
 	checkErr(err)
 }
@@ -45,3 +291,27 @@ func createGauge(name, help string, labels map[string]string) prometheus.Gauge {
 
 	return gauge
 }
+
+func createCounterVec(name, help string, labelNames []string) *prometheus.CounterVec {
+	counterVec := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      name,
+			Namespace: exporterNamespace,
+			Help:      help,
+		}, labelNames)
+	prometheus.MustRegister(counterVec)
+
+	return counterVec
+}
+
+func createGaugeVec(name, help string, labelNames []string) *prometheus.GaugeVec {
+	gaugeVec := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      name,
+			Namespace: exporterNamespace,
+			Help:      help,
+		}, labelNames)
+	prometheus.MustRegister(gaugeVec)
+
+	return gaugeVec
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestPublishMetricsRemovesResources(t *testing.T) {
+	config := newTestConfig(t, `
+resources: [cpu, memory, ephemeral-storage]
+namespaces:
+  - name: shop
+`)
+	createMetrics(config)
+
+	snapshot := &capacitySnapshotType{
+		Complete: true,
+		Apps: []*appCapacityType{{
+			App:         "shop",
+			Free:        resourcesType{v1.ResourceCPU: 1000, v1.ResourceMemory: 1000, v1.ResourceEphemeralStorage: 1000, v1.ResourcePods: 10},
+			Allocatable: resourcesType{v1.ResourceCPU: 2000, v1.ResourceMemory: 2000, v1.ResourceEphemeralStorage: 2000, v1.ResourcePods: 20},
+			OneRPSCost:  map[v1.ResourceName]float64{v1.ResourceCPU: 1, v1.ResourceMemory: 1, v1.ResourceEphemeralStorage: 1},
+		}},
+	}
+
+	publishMetrics(config, snapshot)
+	if count := testutil.CollectAndCount(metricFree); count != 4 {
+		t.Fatalf("capacity_free has %d series, want 4", count)
+	}
+
+	config.Resources = []v1.ResourceName{v1.ResourceCPU}
+	publishMetrics(config, snapshot)
+
+	tests := []struct {
+		name string
+		vec  *prometheus.GaugeVec
+		want int
+	}{
+		{"capacity_free", metricFree, 2},
+		{"capacity_allocatable", metricAllocatable, 2},
+		{"capacity_rps_cost", metricRPSCost, 1},
+	}
+
+	for _, test := range tests {
+		if count := testutil.CollectAndCount(test.vec); count != test.want {
+			t.Errorf("%s has %d series after removing resources, want %d", test.name, count, test.want)
+		}
+	}
+}
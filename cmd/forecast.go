@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/prometheus/common/model"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Values of forecast.seasonality in config.yaml
+const (
+	seasonalityNone   = "none"
+	seasonalityDaily  = "daily"
+	seasonalityWeekly = "weekly"
+)
+
+const (
+	forecastDefaultHistory     = "28d"
+	forecastDefaultStep        = "1h"
+	forecastDefaultHorizonDays = 30
+
+	day  = 24 * time.Hour
+	week = 7 * day
+)
+
+// Projection of the app's adjusted RPS
+// Resources which are not exhausted within the horizon are absent in DaysUntilExhaustion
+type forecastType struct {
+	Error string `json:"error,omitempty"`
+
+	Seasonality         string                      `json:"seasonality,omitempty"`
+	TrendPerDay         float64                     `json:"trend_rps_per_day"`
+	HorizonDays         int64                       `json:"horizon_days"`
+	ProjectedPeakRPS    int64                       `json:"projected_peak_rps"`
+	MaxRPS              map[v1.ResourceName]float64 `json:"max_rps"`
+	DaysUntilExhaustion map[v1.ResourceName]float64 `json:"days_until_exhaustion"`
+}
+
+// Linear trend plus the average deviation from it in every slot of the season
+type forecastModelType struct {
+	FittedAt time.Time
+	// Time of the last point of history, projection starts from it
+	LastPoint   time.Time
+	Seasonality string
+	Step        time.Duration
+
+	// RPS = Intercept + Slope * unix seconds + Season[slot]
+	Intercept float64
+	Slope     float64
+	Season    []float64
+}
+
+// Fitted models by app, history changes only once per step, so models are refitted once per step
+var forecastModels = make(map[string]*forecastModelType)
+
+// Forecast adjusted RPS of the app for the next horizon days and find when it outgrows the free resources
+func forecastApp(config *configType, appCapacity *appCapacityType) *forecastType {
+	forecast := &forecastType{HorizonDays: getForecastHorizonDays(config)}
+
+	forecastModel, err := getForecastModel(config, appCapacity.App)
+	if err != nil {
+		forecast.Error = err.Error()
+		return forecast
+	}
+
+	forecast.Seasonality = forecastModel.Seasonality
+	forecast.TrendPerDay = forecastModel.Slope * day.Seconds()
+
+	projection := forecastModel.project(forecastModel.LastPoint, time.Duration(forecast.HorizonDays)*day)
+	for _, value := range projection {
+		if int64(math.Round(value)) > forecast.ProjectedPeakRPS {
+			forecast.ProjectedPeakRPS = int64(math.Round(value))
+		}
+	}
+
+	// RPS the app can take before it or one of its dependencies runs out of every resource
+	forecast.MaxRPS = make(map[v1.ResourceName]float64)
+	for name, headroom := range appCapacity.RPSHeadroomByResource {
+		forecast.MaxRPS[name] = float64(appCapacity.AdjustedRPS) + headroom
+	}
+	forecast.DaysUntilExhaustion = calculateDaysUntilExhaustion(projection, forecastModel.Step, float64(appCapacity.AdjustedRPS), forecast.MaxRPS)
+
+	logCalc.Debug("forecast", "namespace", appCapacity.App, "seasonality", forecast.Seasonality, "trendPerDay", forecast.TrendPerDay, "projectedPeakRPS", forecast.ProjectedPeakRPS, "daysUntilExhaustion", forecast.DaysUntilExhaustion)
+	return forecast
+}
+
+// Find the first projected point above the maximum RPS of every resource
+func calculateDaysUntilExhaustion(projection []float64, step time.Duration, currentRPS float64, maxRPS map[v1.ResourceName]float64) map[v1.ResourceName]float64 {
+	daysUntilExhaustion := make(map[v1.ResourceName]float64)
+
+	for name, resourceMaxRPS := range maxRPS {
+		if currentRPS >= resourceMaxRPS {
+			daysUntilExhaustion[name] = 0
+			continue
+		}
+
+		for pointNum, value := range projection {
+			if value > resourceMaxRPS {
+				daysUntilExhaustion[name] = float64(pointNum+1) * step.Hours() / 24
+				break
+			}
+		}
+	}
+
+	return daysUntilExhaustion
+}
+
+// Get the cached model or fit a new one from the history of adjusted RPS
+func getForecastModel(config *configType, app string) (*forecastModelType, error) {
+	history, step, err := getForecastRange(config)
+	if err != nil {
+		return nil, err
+	}
+
+	forecastModel, exists := forecastModels[app]
+	if exists && time.Since(forecastModel.FittedAt) < step && replayedSnapshot == nil {
+		return forecastModel, nil
+	}
+
+	matrixResult, err := promRangeRequest(config, parsePromQuery(config, app), history, step)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first series is used, the same as for instant RPS
+	if len(matrixResult) == 0 {
+		return nil, fmt.Errorf("no RPS history for the forecast")
+	}
+
+	var times, values []float64
+	for _, samplePair := range matrixResult[0].Values {
+		times = append(times, float64(samplePair.Timestamp.Unix()))
+		values = append(values, float64(adjustRPS(config, app, int64(math.Round(float64(samplePair.Value))))))
+	}
+
+	forecastModel, err = fitForecastModel(times, values, step, getSeasonality(config, history))
+	if err != nil {
+		return nil, err
+	}
+	forecastModel.LastPoint = time.Unix(int64(times[len(times)-1]), 0)
+
+	forecastModels[app] = forecastModel
+	return forecastModel, nil
+}
+
+// Fit the linear trend with least squares and average the residuals by the slot of the season
+func fitForecastModel(times, values []float64, step time.Duration, seasonality string) (*forecastModelType, error) {
+	var timeMean, valueMean, covariance, variance float64
+
+	if len(values) < 2 {
+		return nil, fmt.Errorf("not enough RPS history for the forecast: %d points", len(values))
+	}
+
+	for pointNum := range values {
+		timeMean += times[pointNum]
+		valueMean += values[pointNum]
+	}
+	timeMean /= float64(len(values))
+	valueMean /= float64(len(values))
+
+	for pointNum := range values {
+		covariance += (times[pointNum] - timeMean) * (values[pointNum] - valueMean)
+		variance += (times[pointNum] - timeMean) * (times[pointNum] - timeMean)
+	}
+
+	forecastModel := &forecastModelType{
+		FittedAt:    time.Now(),
+		Seasonality: seasonality,
+		Step:        step,
+	}
+	if variance > 0 {
+		forecastModel.Slope = covariance / variance
+	}
+	forecastModel.Intercept = valueMean - forecastModel.Slope*timeMean
+
+	slots := forecastModel.seasonSlots()
+	if slots == 0 {
+		return forecastModel, nil
+	}
+
+	forecastModel.Season = make([]float64, slots)
+	slotPoints := make([]int, slots)
+	for pointNum := range values {
+		slot := forecastModel.seasonSlot(times[pointNum])
+		forecastModel.Season[slot] += values[pointNum] - forecastModel.Intercept - forecastModel.Slope*times[pointNum]
+		slotPoints[slot]++
+	}
+	for slot := range forecastModel.Season {
+		if slotPoints[slot] > 0 {
+			forecastModel.Season[slot] /= float64(slotPoints[slot])
+		}
+	}
+
+	return forecastModel, nil
+}
+
+// Project RPS for every step of the horizon after the start, RPS cannot be negative
+func (forecastModel *forecastModelType) project(start time.Time, horizon time.Duration) []float64 {
+	var projection []float64
+
+	for point := start.Add(forecastModel.Step); !point.After(start.Add(horizon)); point = point.Add(forecastModel.Step) {
+		seconds := float64(point.Unix())
+		value := forecastModel.Intercept + forecastModel.Slope*seconds
+
+		if len(forecastModel.Season) > 0 {
+			value += forecastModel.Season[forecastModel.seasonSlot(seconds)]
+		}
+
+		projection = append(projection, math.Max(value, 0))
+	}
+
+	return projection
+}
+
+func (forecastModel *forecastModelType) seasonSlots() int {
+	switch forecastModel.Seasonality {
+	case seasonalityDaily:
+		return int(day / forecastModel.Step)
+	case seasonalityWeekly:
+		return int(week / forecastModel.Step)
+	}
+	return 0
+}
+
+func (forecastModel *forecastModelType) seasonSlot(seconds float64) int {
+	slots := forecastModel.seasonSlots()
+	return int(seconds/forecastModel.Step.Seconds()) % slots
+}
+
+// Weekly seasonality needs at least two weeks of history and daily two days
+func getSeasonality(config *configType, history time.Duration) string {
+	if config.Forecast.Seasonality != "" {
+		return config.Forecast.Seasonality
+	}
+
+	switch {
+	case history >= 2*week:
+		return seasonalityWeekly
+	case history >= 2*day:
+		return seasonalityDaily
+	}
+	return seasonalityNone
+}
+
+func getForecastHorizonDays(config *configType) int64 {
+	if config.Forecast.HorizonDays == 0 {
+		return forecastDefaultHorizonDays
+	}
+	return config.Forecast.HorizonDays
+}
+
+func getForecastRange(config *configType) (time.Duration, time.Duration, error) {
+	history := config.Forecast.History
+	if history == "" {
+		history = forecastDefaultHistory
+	}
+
+	step := config.Forecast.Step
+	if step == "" {
+		step = forecastDefaultStep
+	}
+
+	historyDuration, err := model.ParseDuration(history)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid forecast.history: %w", err)
+	}
+
+	stepDuration, err := model.ParseDuration(step)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid forecast.step: %w", err)
+	}
+
+	return time.Duration(historyDuration), time.Duration(stepDuration), nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Midnight UTC, so hourly points of a day fall into slots 0-23
+const forecastTestStart = 1699920000
+
+func newForecastHistory(days int, value func(pointNum int) float64) ([]float64, []float64) {
+	var times, values []float64
+
+	for pointNum := 0; pointNum < days*24; pointNum++ {
+		times = append(times, float64(forecastTestStart+pointNum*3600))
+		values = append(values, value(pointNum))
+	}
+
+	return times, values
+}
+
+func floatsAreClose(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestFitForecastModelLinearTrend(t *testing.T) {
+	times, values := newForecastHistory(3, func(pointNum int) float64 { return 100 + 2*float64(pointNum) })
+
+	for _, seasonality := range []string{seasonalityNone, seasonalityDaily} {
+		t.Run(seasonality, func(t *testing.T) {
+			forecastModel, err := fitForecastModel(times, values, time.Hour, seasonality)
+			if err != nil {
+				t.Fatalf("fitForecastModel() error = %v", err)
+			}
+
+			if trendPerHour := forecastModel.Slope * 3600; !floatsAreClose(trendPerHour, 2) {
+				t.Errorf("trend = %v RPS per hour, want 2", trendPerHour)
+			}
+			for slot, deviation := range forecastModel.Season {
+				if !floatsAreClose(deviation, 0) {
+					t.Errorf("season[%d] = %v, want 0 for a pure trend", slot, deviation)
+				}
+			}
+
+			lastValue := values[len(values)-1]
+			projection := forecastModel.project(time.Unix(int64(times[len(times)-1]), 0), 3*time.Hour)
+			if len(projection) != 3 {
+				t.Fatalf("project() returned %d points, want 3", len(projection))
+			}
+			for pointNum, value := range projection {
+				if want := lastValue + 2*float64(pointNum+1); !floatsAreClose(value, want) {
+					t.Errorf("projection[%d] = %v, want %v", pointNum, value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFitForecastModelDailySeason(t *testing.T) {
+	// Peak from 10:00 to 13:59, symmetric within the day so the trend is flat
+	dailyRPS := func(hour int) float64 {
+		if hour >= 10 && hour <= 13 {
+			return 150
+		}
+		return 100
+	}
+	times, values := newForecastHistory(4, func(pointNum int) float64 { return dailyRPS(pointNum % 24) })
+
+	forecastModel, err := fitForecastModel(times, values, time.Hour, seasonalityDaily)
+	if err != nil {
+		t.Fatalf("fitForecastModel() error = %v", err)
+	}
+
+	if !floatsAreClose(forecastModel.Slope, 0) {
+		t.Errorf("slope = %v, want 0", forecastModel.Slope)
+	}
+	if len(forecastModel.Season) != 24 {
+		t.Fatalf("season has %d slots, want 24", len(forecastModel.Season))
+	}
+
+	// The next day repeats the pattern
+	projection := forecastModel.project(time.Unix(int64(times[len(times)-1]), 0), day)
+	if len(projection) != 24 {
+		t.Fatalf("project() returned %d points, want 24", len(projection))
+	}
+	for hour, value := range projection {
+		if !floatsAreClose(value, dailyRPS(hour)) {
+			t.Errorf("projection at %02d:00 = %v, want %v", hour, value, dailyRPS(hour))
+		}
+	}
+}
+
+func TestFitForecastModelErrors(t *testing.T) {
+	_, err := fitForecastModel([]float64{forecastTestStart}, []float64{100}, time.Hour, seasonalityNone)
+	if err == nil {
+		t.Errorf("fitForecastModel() with one point error = nil, want an error")
+	}
+}
+
+func TestProjectIsNotNegative(t *testing.T) {
+	forecastModel := &forecastModelType{Step: time.Hour, Intercept: 10, Slope: -20.0 / 3600}
+
+	projection := forecastModel.project(time.Unix(0, 0), 3*time.Hour)
+	want := []float64{0, 0, 0}
+	if len(projection) != len(want) {
+		t.Fatalf("project() returned %d points, want %d", len(projection), len(want))
+	}
+	for pointNum := range want {
+		if projection[pointNum] != want[pointNum] {
+			t.Errorf("projection[%d] = %v, want %v", pointNum, projection[pointNum], want[pointNum])
+		}
+	}
+}
+
+func TestSeasonSlot(t *testing.T) {
+	// Slots are counted from the Unix epoch
+	tests := []struct {
+		name        string
+		seasonality string
+		step        time.Duration
+		sinceEpoch  time.Duration
+		wantSlots   int
+		wantSlot    int
+	}{
+		{"daily midnight", seasonalityDaily, time.Hour, 0, 24, 0},
+		{"daily next day", seasonalityDaily, time.Hour, 25 * time.Hour, 24, 1},
+		{"daily inside the step", seasonalityDaily, time.Hour, 23*time.Hour + 59*time.Minute, 24, 23},
+		{"daily half an hour step", seasonalityDaily, 30 * time.Minute, 90 * time.Minute, 48, 3},
+		{"weekly", seasonalityWeekly, time.Hour, 8*day + 3*time.Hour, 168, 27},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forecastModel := &forecastModelType{Seasonality: test.seasonality, Step: test.step}
+
+			if slots := forecastModel.seasonSlots(); slots != test.wantSlots {
+				t.Errorf("seasonSlots() = %d, want %d", slots, test.wantSlots)
+			}
+			if slot := forecastModel.seasonSlot(test.sinceEpoch.Seconds()); slot != test.wantSlot {
+				t.Errorf("seasonSlot() = %d, want %d", slot, test.wantSlot)
+			}
+		})
+	}
+
+	if slots := (&forecastModelType{Seasonality: seasonalityNone, Step: time.Hour}).seasonSlots(); slots != 0 {
+		t.Errorf("seasonSlots() without seasonality = %d, want 0", slots)
+	}
+}
+
+func TestCalculateDaysUntilExhaustion(t *testing.T) {
+	tests := []struct {
+		name       string
+		projection []float64
+		step       time.Duration
+		currentRPS float64
+		maxRPS     float64
+		want       float64
+		wantAbsent bool
+	}{
+		{
+			name:       "first point above max",
+			projection: []float64{100, 150, 200, 250},
+			step:       6 * time.Hour,
+			currentRPS: 100,
+			maxRPS:     180,
+			want:       0.75,
+		},
+		{
+			name:       "point equal to max is not exhaustion",
+			projection: []float64{100, 180, 181},
+			step:       12 * time.Hour,
+			currentRPS: 100,
+			maxRPS:     180,
+			want:       1.5,
+		},
+		{
+			name:       "hourly steps",
+			projection: append(make([]float64, 47), 500),
+			step:       time.Hour,
+			currentRPS: 100,
+			maxRPS:     200,
+			want:       2,
+		},
+		{
+			name:       "already exhausted",
+			projection: []float64{100},
+			step:       time.Hour,
+			currentRPS: 300,
+			maxRPS:     300,
+			want:       0,
+		},
+		{
+			name:       "never exhausted",
+			projection: []float64{100, 150, 200},
+			step:       time.Hour,
+			currentRPS: 100,
+			maxRPS:     1000,
+			wantAbsent: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := calculateDaysUntilExhaustion(test.projection, test.step, test.currentRPS, map[v1.ResourceName]float64{v1.ResourceCPU: test.maxRPS})
+
+			days, exists := got[v1.ResourceCPU]
+			if test.wantAbsent {
+				if exists {
+					t.Errorf("calculateDaysUntilExhaustion() = %v days, want no exhaustion", days)
+				}
+				return
+			}
+			if !exists || days != test.want {
+				t.Errorf("calculateDaysUntilExhaustion() = %v, want %v days", got, test.want)
+			}
+		})
+	}
+}
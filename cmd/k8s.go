@@ -2,37 +2,53 @@ package main
 
 import (
 	"context"
-	"strings"
+	"fmt"
+	"os"
+	"sync"
 
-	appsV1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/metrics/pkg/apis/metrics/v1beta1"
 	metricsv "k8s.io/metrics/pkg/client/clientset/versioned"
 )
 
-// Count amount of used Cpu and Memory for specified namespace and deployment
-func getUsedResources(namespace string, deploymentName ...string) (int64, int64) {
-	var cpuSum, memSum int64
-	actualDeploymentName := checkVariadic(deploymentName)
-	podMetricsList := getPodMetricsList(namespace)
+// Reasons of node exclusion in capacity_node_excluded metric
+const (
+	nodeExcludedUnschedulable = "unschedulable"
+	nodeExcludedNotReady      = "not_ready"
+	nodeExcludedAffinity      = "affinity"
+	nodeExcludedTaint         = "taint"
+)
+
+// Set from --kubeconfig and --context flags
+var kubeconfigPath, kubeContext string
+
+// Count amount of used resources for the specified pods
+// Metrics API reports only Cpu and Memory, other resources are counted as unused
+func getUsedResources(config *configType, podMetricsList *v1beta1.PodMetricsList, podList *v1.PodList) resourcesType {
+	usedResources := v1.ResourceList{}
+	podNames := make(map[string]bool)
+
+	for _, pod := range podList.Items {
+		podNames[pod.Namespace+"/"+pod.Name] = true
+	}
 
 	for _, pod := range podMetricsList.Items {
-		if strings.HasPrefix(pod.Name, actualDeploymentName) {
+		if podNames[pod.Namespace+"/"+pod.Name] {
 			for _, container := range pod.Containers {
-				printWithTabs("Pod: "+pod.Name+"\tContainer: "+container.Name, 10)
-				printDebug("UsedMilliCpu: %+v\t", container.Usage.Cpu().MilliValue())
-				printDebug("UsedMem: %+v\n", container.Usage.Memory().Value())
+				logK8s.Debug("container usage", "pod", pod.Name, "container", container.Name, "usedMilliCPU", container.Usage.Cpu().MilliValue(), "usedMem", container.Usage.Memory().Value())
 
-				cpuSum += container.Usage.Cpu().MilliValue()
-				memSum += container.Usage.Memory().Value()
+				addResourceList(usedResources, container.Usage)
 			}
 		}
 	}
 
-	return cpuSum, memSum
+	return toResources(config, usedResources)
 }
 
 // DEPRECATED function!
@@ -52,353 +68,423 @@ func getTotalRequestedResources(nodes []string, pods *v1.PodList) (int64, int64)
 	return cpuSum, memSum
 }
 
-// Get amount of requested memory and cpu for specified deployment
-func getDeploymentRequestedResources(namespace, deploymentName string) (int64, int64) {
-	var cpuSum, memSum, replicaCount int64
-	deploymentList := getDeploymentList(namespace)
-
-	if len(deploymentList.Items) > 0 {
-		for _, deployment := range deploymentList.Items {
-			if deployment.Name == deploymentName {
-
-				var containerCPU, containerMem int64
-				replicaCount = int64(*deployment.Spec.Replicas)
-				containers := deployment.Spec.Template.Spec.Containers
-
-				if len(containers) > 0 {
-					for _, container := range containers {
-						containerCPU += container.Resources.Requests.Cpu().MilliValue()
-						containerMem += container.Resources.Requests.Memory().Value()
-					}
-				}
-				cpuSum += containerCPU * replicaCount
-				memSum += containerMem * replicaCount
+// Get amount of requested resources for specified workload
+func getWorkloadRequestedResources(config *configType, workload *workloadType) resourcesType {
+	podSpec := workload.PodSpec
 
+	// Overhead is set by RuntimeClass admission on pods only, templates have to be resolved here
+	if podSpec.Overhead == nil && podSpec.RuntimeClassName != nil {
+		runtimeClass, err := runtimeClassLister.Get(*podSpec.RuntimeClassName)
+		if err != nil {
+			logK8s.Warn("cannot get runtime class, pod overhead is ignored", "namespace", workload.Namespace, "runtimeClass", *podSpec.RuntimeClassName, "err", err)
+		} else {
+			recordRuntimeClass(runtimeClass)
+			if runtimeClass.Overhead != nil {
+				podSpec.Overhead = runtimeClass.Overhead.PodFixed
 			}
 		}
 	}
 
-	return cpuSum, memSum
+	podRequests := toResources(config, getPodRequests(&podSpec))
+
+	return multiplyResources(podRequests, workload.Replicas)
 }
 
-// Get total amount of free (allocatable minus really occupied) memory and cpu for nodes with relevant labels in the specific namespace
-// If allowed labels are specified then count the node only if the labels match
-// If forbidden labels are specified then count the node only if the labels do not match
-func getFreeResources(namespace, deploymentName string, deploymentLabels deploymentLabelsType, nodeList *v1.NodeList, podList *v1.PodList, podMetricsList *v1beta1.PodMetricsList, reallyOccupiedDeploymentCPU, reallyOccupiedDeploymentMem int64, podsAmount int) (int64, int64, int64, int64, []string) {
-	var everythingAllowed, nothingForbidden, thisNodeIsAllowed, thisNodeIsForbidden bool
-	var freeCPUSum, freeMemSum, allocatableCPUSum, allocatableMemSum int64
-	var allowedNodes []string
+// Calculate effective pod requests the way kube-scheduler does:
+// max(sum of app containers and sidecars, largest init container plus sidecars started before it) plus pod overhead
+func getPodRequests(podSpec *v1.PodSpec) v1.ResourceList {
+	podRequests := v1.ResourceList{}
+	sidecarRequests := v1.ResourceList{}
+	initContainerRequests := v1.ResourceList{}
 
-	if len(deploymentLabels.Allowed) > 0 {
-		everythingAllowed = false
-	} else {
-		everythingAllowed = true
+	for _, container := range podSpec.Containers {
+		addResourceList(podRequests, container.Resources.Requests)
 	}
 
-	if len(deploymentLabels.Forbidden) > 0 {
-		nothingForbidden = false
-	} else {
-		nothingForbidden = true
-	}
+	for _, initContainer := range podSpec.InitContainers {
+		// Requests of a container without resources are nil
+		containerRequests := v1.ResourceList{}
+		addResourceList(containerRequests, initContainer.Resources.Requests)
 
-	for _, node := range nodeList.Items {
-		if everythingAllowed && nothingForbidden {
-			printDebug("All nodes are allowed, none are forbidden. ")
-			thisNodeIsAllowed = true
+		// Native sidecars keep running along with app containers
+		if initContainer.RestartPolicy != nil && *initContainer.RestartPolicy == v1.ContainerRestartPolicyAlways {
+			addResourceList(podRequests, containerRequests)
+			addResourceList(sidecarRequests, containerRequests)
+			containerRequests = sidecarRequests.DeepCopy()
 		} else {
+			addResourceList(containerRequests, sidecarRequests)
+		}
 
-			if !everythingAllowed && !nothingForbidden {
-
-				thisNodeIsForbidden = labelsAreEqual(node.Labels, deploymentLabels.Forbidden, "both-forbidden")
-				if !thisNodeIsForbidden {
-					thisNodeIsAllowed = labelsAreEqual(node.Labels, deploymentLabels.Allowed, "both-allowed")
-				}
+		maxResourceList(initContainerRequests, containerRequests)
+	}
 
-			} else {
+	maxResourceList(podRequests, initContainerRequests)
+	addResourceList(podRequests, podSpec.Overhead)
 
-				if !everythingAllowed {
-					thisNodeIsAllowed = labelsAreEqual(node.Labels, deploymentLabels.Allowed, "allowed")
-				}
-				if !nothingForbidden {
-					thisNodeIsAllowed = !labelsAreEqual(node.Labels, deploymentLabels.Forbidden, "forbidden")
-				}
+	return podRequests
+}
 
-			}
+// Get total amount of free (allocatable minus really occupied) resources for nodes the workload may be scheduled on
+// Pod slots (allocatable pods minus running pods) are counted as "pods" resource
+// Free resources of every allowed node are returned as well (marked if counted), excluded nodes are returned with the reason of exclusion
+func getFreeResources(config *configType, workload *workloadType, nodeList *v1.NodeList, podList *v1.PodList, podMetricsList *v1beta1.PodMetricsList, reallyOccupiedWorkload resourcesType, podsAmount int) (resourcesType, resourcesType, []nodeFreeResourcesType, map[string]string) {
+	var allowedNodes []nodeFreeResourcesType
+	freeSum := make(resourcesType)
+	allocatableSum := make(resourcesType)
+	reallyOccupiedPod := make(resourcesType)
+	excludedNodes := make(map[string]string)
+
+	if podsAmount > 0 {
+		reallyOccupiedPod = divideResources(reallyOccupiedWorkload, int64(podsAmount))
+	}
+	logK8s.Debug("resources needed for one pod", "namespace", workload.Namespace, "resources", reallyOccupiedPod)
 
+	for _, node := range nodeList.Items {
+		exclusionReason := getNodeExclusionReason(config, &node, workload)
+		if exclusionReason != "" {
+			logK8s.Debug("node is excluded", "node", node.Name, "reason", exclusionReason)
+			excludedNodes[node.Name] = exclusionReason
+			continue
 		}
+		logK8s.Debug("node is allowed", "node", node.Name)
 
-		if thisNodeIsAllowed {
-			printDebug("Node \"%+v\" is allowed ", node.Name)
+		reallyOccupiedNode := getNodeReallyOccupiedResources(config, node.Name, podList, podMetricsList)
+		allocatableNode := getNodeAllocatableResources(config, &node)
+		logK8s.Debug("node allocatable resources", "node", node.Name, "resources", allocatableNode)
 
-			if !nodeIsTainted(namespace, deploymentName, node.Spec.Taints) {
-				printDebug("and not tainted!\n")
+		addResources(allocatableSum, allocatableNode)
 
-				reallyOccupiedNodeCPU, reallyOccupiedNodeMem := getNodeReallyOccupiedResources(node.Name, podList, podMetricsList)
-				allocatableCPU := node.Status.Capacity.Cpu().MilliValue()
-				allocatableMem := node.Status.Capacity.Memory().Value()
-				printDebug("Allocatable MilliCpuSum: %+v\nAllocatable MemSum: %+v\n", allocatableCPU, allocatableMem)
+		freeNode := make(resourcesType)
+		nodeFitsPod := true
+		for name, allocatable := range allocatableNode {
+			freeNode[name] = allocatable - reallyOccupiedNode[name]
 
-				allocatableCPUSum += allocatableCPU
-				allocatableMemSum += allocatableMem
+			if freeNode[name] < reallyOccupiedPod[name] {
+				nodeFitsPod = false
+			}
+		}
+		allocatablePodsNode := node.Status.Allocatable.Pods().Value()
+		freePodsNode := allocatablePodsNode - countNodePods(node.Name, podList)
+		logK8s.Debug("node free resources", "node", node.Name, "resources", freeNode, "pods", freePodsNode)
 
-				freeCPUNode := allocatableCPU - reallyOccupiedNodeCPU
-				freeMemNode := allocatableMem - reallyOccupiedNodeMem
-				printDebug("Free MilliCpuSum (for node): %+v\nFree MemSum (for node): %+v\n", freeCPUNode, freeMemNode)
+		allocatableSum[v1.ResourcePods] += allocatablePodsNode
 
-				reallyOccupiedPodCPU := reallyOccupiedDeploymentCPU / int64(podsAmount)
-				reallyOccupiedPodMem := reallyOccupiedDeploymentMem / int64(podsAmount)
-				printDebug("MilliCpuSum needed for one pod: %+v\nMemSum needed for one pod: %+v\n", reallyOccupiedPodCPU, reallyOccupiedPodMem)
+		// Count node's resources only if the node has enough resources and a free slot for at least one pod
+		nodeCounted := nodeFitsPod && freePodsNode > 0
+		if nodeCounted {
+			addResources(freeSum, freeNode)
+			freeSum[v1.ResourcePods] += freePodsNode
+		}
 
-				// Count node's resources only if the node has enough resources for at least one pod
-				if freeCPUNode >= reallyOccupiedPodCPU && freeMemNode >= reallyOccupiedPodMem {
-					freeCPUSum += freeCPUNode
-					freeMemSum += freeMemNode
-				}
+		logK8s.Debug("namespace free resources (intermediate)", "namespace", workload.Namespace, "resources", freeSum)
+
+		allowedNodes = append(allowedNodes, nodeFreeResourcesType{
+			Name:      node.Name,
+			Resources: freeNode,
+			Pods:      freePodsNode,
+			Counted:   nodeCounted,
+		})
+	}
 
-				printDebug("Free MilliCpuSum (for namespace, intermediate): %+v\nFree MemSum (for namespace, intermediate): %+v\n", freeCPUSum, freeMemSum)
+	return freeSum, allocatableSum, allowedNodes, excludedNodes
+}
 
-				allowedNodes = append(allowedNodes, node.Name)
+// Get node resources available for pods: Status.Allocatable by default or Status.Capacity if configured
+// Capacity includes kube-reserved and system-reserved resources
+func getNodeAllocatableResources(config *configType, node *v1.Node) resourcesType {
+	if config.NodeResources == nodeResourcesCapacity {
+		return toResources(config, node.Status.Capacity)
+	}
+	return toResources(config, node.Status.Allocatable)
+}
 
-			} else {
-				printDebug("BUT tainted!\n")
-			}
+// Sum allocatable and capacity resources of nodes grouped by the node pool label
+func getNodePoolResources(config *configType, nodeList *v1.NodeList) map[string]nodePoolResourcesType {
+	nodePools := make(map[string]nodePoolResourcesType)
+
+	for _, node := range nodeList.Items {
+		poolName := node.Labels[config.NodePoolLabel]
+		if config.NodePoolLabel == "" || poolName == "" {
+			poolName = defaultNodePool
 		}
 
+		nodePool := nodePools[poolName]
+		nodePool.AllocatableCPU += node.Status.Allocatable.Cpu().MilliValue()
+		nodePool.AllocatableMemory += node.Status.Allocatable.Memory().Value()
+		nodePool.CapacityCPU += node.Status.Capacity.Cpu().MilliValue()
+		nodePool.CapacityMemory += node.Status.Capacity.Memory().Value()
+		nodePools[poolName] = nodePool
 	}
 
-	return freeCPUSum, freeMemSum, allocatableCPUSum, allocatableMemSum, allowedNodes
+	return nodePools
 }
 
-func labelsAreEqual(nodeLabels map[string]string, deploymentLabels []allowedAndForbiddenLabelsType, checkType ...string) bool {
-	labelsAreEqual := false
-
-	for nodeLabelKey, nodeLabelValue := range nodeLabels {
-		printDebug("%s check %s", printWithTabs("Nodelabel: "+nodeLabelKey, 6, false), checkType[0])
-		for _, deploymentLabel := range deploymentLabels {
-			// Do not count this node if the node and the deployment has the same label...
-			if nodeLabelKey == deploymentLabel.Key {
-				for _, deploymentLabelValue := range deploymentLabel.Values {
-					// ...with the same value
-					if nodeLabelValue == deploymentLabelValue {
-						labelsAreEqual = true
-					}
-				}
-			}
-		}
-		printDebug("\t%v\n", labelsAreEqual)
+// Return the reason why the workload's pods cannot be scheduled on the node, empty if they can
+func getNodeExclusionReason(config *configType, node *v1.Node, workload *workloadType) string {
+	unschedulableTaint := v1.Taint{Key: v1.TaintNodeUnschedulable, Effect: v1.TaintEffectNoSchedule}
+
+	if node.Spec.Unschedulable && !taintIsTolerated(&unschedulableTaint, workload.PodSpec.Tolerations) {
+		return nodeExcludedUnschedulable
 	}
 
-	return labelsAreEqual
-}
+	if !nodeIsReady(node) {
+		return nodeExcludedNotReady
+	}
 
-// Check if the deployment tolerates to all node's taints
-func nodeIsTainted(namespace, deploymentName string, nodeTaints []v1.Taint) bool {
-	nodeIsTainted := false
+	if !nodeMatchesAffinity(config, node, &workload.PodSpec) {
+		return nodeExcludedAffinity
+	}
 
-	if len(nodeTaints) > 0 {
-		deploymentList := getDeploymentList(namespace)
-		if len(deploymentList.Items) > 0 {
-			for _, taint := range nodeTaints {
-				nodeIsTainted = true
+	if nodeIsTainted(workload, node.Spec.Taints) {
+		return nodeExcludedTaint
+	}
 
-				for _, deployment := range deploymentList.Items {
-					if deployment.Name == deploymentName {
+	return ""
+}
 
-						for _, toleration := range deployment.Spec.Template.Spec.Tolerations {
-							if toleration.Key == taint.Key {
-								if toleration.Operator == "Exists" || (toleration.Operator == "Equal" && toleration.Value == taint.Value) {
-									nodeIsTainted = false
-								}
-							}
-						}
+// Check if the workload does not tolerate some of node's NoSchedule or NoExecute taints
+// PreferNoSchedule taints do not prevent scheduling
+func nodeIsTainted(workload *workloadType, nodeTaints []v1.Taint) bool {
+	for _, taint := range nodeTaints {
+		if taint.Effect != v1.TaintEffectNoSchedule && taint.Effect != v1.TaintEffectNoExecute {
+			continue
+		}
 
-						if nodeIsTainted {
-							return nodeIsTainted
-						}
+		if !taintIsTolerated(&taint, workload.PodSpec.Tolerations) {
+			logK8s.Debug("taint is not tolerated", "namespace", workload.Namespace, "key", taint.Key, "value", taint.Value, "effect", taint.Effect)
+			return true
+		}
+	}
 
-					}
-				}
+	return false
+}
+
+// Same rules as in Toleration.ToleratesTaint of k8s.io/api
+func taintIsTolerated(taint *v1.Taint, tolerations []v1.Toleration) bool {
+	for _, toleration := range tolerations {
+		if toleration.Effect != "" && toleration.Effect != taint.Effect {
+			continue
+		}
 
+		// Empty key with Exists operator tolerates everything
+		if toleration.Key != "" && toleration.Key != taint.Key {
+			continue
+		}
+
+		switch toleration.Operator {
+		case v1.TolerationOpExists:
+			return true
+		case v1.TolerationOpEqual, "":
+			if toleration.Value == taint.Value {
+				return true
 			}
 		}
 	}
 
-	return nodeIsTainted
+	return false
 }
 
-// Calculate how much resources if really used on the node
-func getNodeReallyOccupiedResources(nodeName string, podAPIList *v1.PodList, podMetricsList *v1beta1.PodMetricsList) (int64, int64) {
-	var requestedCPUSumPod, requestedMemSumPod, usedCPUSumPod, usedMemSumPod, reallyOccupiedCPUSumNode, reallyOccupiedMemSumNode int64
+// Count pods which occupy a slot on the node (finished pods do not)
+func countNodePods(nodeName string, podList *v1.PodList) int64 {
+	var podCount int64
 
-	printDebug("Really Occupied Resources on node %+v:\n", nodeName)
+	for _, pod := range podList.Items {
+		if pod.Spec.NodeName == nodeName && pod.Status.Phase != v1.PodSucceeded && pod.Status.Phase != v1.PodFailed {
+			podCount++
+		}
+	}
 
-	for _, podAPI := range podAPIList.Items {
-		if podAPI.Spec.NodeName == nodeName {
-			requestedCPUSumPod = 0
-			requestedMemSumPod = 0
-			usedCPUSumPod = 0
-			usedMemSumPod = 0
+	return podCount
+}
 
-			printDebug("Pod \"%+v\" in namespace \"%+v\":\n", podAPI.Name, podAPI.Namespace)
+func nodeIsReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
 
-			for _, containerAPI := range podAPI.Spec.Containers {
-				requestedCPUSumPod += containerAPI.Resources.Requests.Cpu().MilliValue()
-				requestedMemSumPod += containerAPI.Resources.Requests.Memory().Value()
-			}
+// Calculate how much resources if really used on the node
+func getNodeReallyOccupiedResources(config *configType, nodeName string, podAPIList *v1.PodList, podMetricsList *v1beta1.PodMetricsList) resourcesType {
+	reallyOccupiedNode := make(resourcesType)
+
+	for _, podAPI := range podAPIList.Items {
+		// Finished pods do not occupy anything, kube-scheduler ignores them too
+		if podAPI.Spec.NodeName == nodeName && podAPI.Status.Phase != v1.PodSucceeded && podAPI.Status.Phase != v1.PodFailed {
+			usedPod := v1.ResourceList{}
 
-			printDebug("Requested MilliCpuSum: %+v\nRequested MemSum: %+v\n", requestedCPUSumPod, requestedMemSumPod)
+			requestedPod := toResources(config, getPodRequests(&podAPI.Spec))
+			logK8s.Debug("pod requested resources", "node", nodeName, "namespace", podAPI.Namespace, "pod", podAPI.Name, "resources", requestedPod)
 
 			for _, podMetrics := range podMetricsList.Items {
 				if podMetrics.Namespace == podAPI.Namespace && podMetrics.Name == podAPI.Name {
 
 					for _, containerMetrics := range podMetrics.Containers {
-						usedCPUSumPod += containerMetrics.Usage.Cpu().MilliValue()
-						usedMemSumPod += containerMetrics.Usage.Memory().Value()
+						addResourceList(usedPod, containerMetrics.Usage)
 					}
 
 				}
 			}
 
-			printDebug("Used MilliCpuSum: %+v\nUsed MemSum: %+v\n", usedCPUSumPod, usedMemSumPod)
+			logK8s.Debug("pod used resources", "node", nodeName, "namespace", podAPI.Namespace, "pod", podAPI.Name, "resources", usedPod)
 
-			reallyOccupiedCPUSumPod, reallyOccupiedMemSumPod := calculateReallyOccupiedResources(usedCPUSumPod, usedMemSumPod, requestedCPUSumPod, requestedMemSumPod)
+			reallyOccupiedPod := calculateReallyOccupiedResources(toResources(config, usedPod), requestedPod)
 
-			printDebug("Really Occupied MilliCpuSum (for pod): %+v\nReally Occupied MemSum (for pod): %+v\n", reallyOccupiedCPUSumPod, reallyOccupiedMemSumPod)
+			logK8s.Debug("pod really occupied resources", "node", nodeName, "namespace", podAPI.Namespace, "pod", podAPI.Name, "resources", reallyOccupiedPod)
 
-			reallyOccupiedCPUSumNode += reallyOccupiedCPUSumPod
-			reallyOccupiedMemSumNode += reallyOccupiedMemSumPod
+			addResources(reallyOccupiedNode, reallyOccupiedPod)
 
 		}
 	}
 
-	printDebug("Really Occupied MilliCpuSum (for node): %+v\nReally Occupied MemSum (for node): %+v\n", reallyOccupiedCPUSumNode, reallyOccupiedMemSumNode)
+	logK8s.Debug("node really occupied resources", "node", nodeName, "resources", reallyOccupiedNode)
 
-	return reallyOccupiedCPUSumNode, reallyOccupiedMemSumNode
+	return reallyOccupiedNode
 }
 
-// Check if the deployment in the specified namespace has some affinities
-func getAntiAffinityLabels(config *configType, namespace, deploymentName string) deploymentLabelsType {
-	var deploymentLabels deploymentLabelsType
-	deploymentList := getDeploymentList(namespace)
-
-	for _, deployment := range deploymentList.Items {
-
-		if deployment.Name == deploymentName {
-
-			specAffinity := deployment.Spec.Template.Spec.Affinity
-			if specAffinity != nil && specAffinity.NodeAffinity != nil && specAffinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
-
-				NodeSelectorTerms := deployment.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
-				for _, nodeSelectorTerm := range NodeSelectorTerms {
+// Get a list of all nodes in the cluster (from the informer cache)
+func getNodeList() (v1.NodeList, error) {
+	var nodeList v1.NodeList
 
-					for _, deploymentAffinity := range nodeSelectorTerm.MatchExpressions {
-
-						for _, configAffinity := range config.Affinity {
-
-							if deploymentAffinity.Key == configAffinity.Key && deploymentAffinity.Operator == configAffinity.Operator {
+	nodes, err := nodeLister.List(labels.Everything())
+	if err != nil {
+		return nodeList, fmt.Errorf("cannot list nodes: %w", err)
+	}
 
-								if deploymentAffinity.Operator == "In" {
-									var labels allowedAndForbiddenLabelsType
-									labels.Key = deploymentAffinity.Key
-									labels.Values = deploymentAffinity.Values
+	for _, node := range nodes {
+		nodeList.Items = append(nodeList.Items, *node)
+	}
+	recordNodes(nodeList.Items)
 
-									deploymentLabels.Allowed = append(deploymentLabels.Allowed, labels)
-								}
-								if deploymentAffinity.Operator == "NotIn" {
-									var labels allowedAndForbiddenLabelsType
-									labels.Key = deploymentAffinity.Key
-									labels.Values = deploymentAffinity.Values
-									deploymentLabels.Forbidden = append(deploymentLabels.Forbidden, labels)
-								}
+	return nodeList, nil
+}
 
-							}
+// Get a list of all or namespaced pods in the cluster (from the informer cache)
+func getPodList(namespace ...string) (v1.PodList, error) {
+	var podList v1.PodList
+	var pods []*v1.Pod
+	var err error
+	actualNamespace := checkVariadic(namespace)
 
-						}
+	if actualNamespace == "" {
+		pods, err = podLister.List(labels.Everything())
+	} else {
+		pods, err = podLister.Pods(actualNamespace).List(labels.Everything())
+	}
+	if err != nil {
+		return podList, fmt.Errorf("cannot list pods: %w", err)
+	}
 
-					}
+	for _, pod := range pods {
+		podList.Items = append(podList.Items, *pod)
+	}
+	recordPods(podList.Items)
 
-				}
+	return podList, nil
+}
 
-			}
+// Pod metrics are not cached, metrics API does not support watching
+func getPodMetricsList(namespace ...string) (v1beta1.PodMetricsList, error) {
+	var podMetricsList v1beta1.PodMetricsList
+	actualNamespace := checkVariadic(namespace)
 
+	if replayedSnapshot != nil {
+		podMetricsList = getSnapshotPodMetricsList(actualNamespace)
+	} else {
+		clientset, err := getMetricsClientset()
+		if err != nil {
+			return podMetricsList, err
 		}
 
+		podMetricsAPIList, err := clientset.MetricsV1beta1().PodMetricses(actualNamespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return podMetricsList, fmt.Errorf("cannot list pod metrics: %w", err)
+		}
+		podMetricsList = *podMetricsAPIList
 	}
 
-	return deploymentLabels
-}
-
-// Get a list of all nodes in the cluster
-func getNodeList() v1.NodeList {
-	clientset := getMetaV1Clientset()
-
-	nodeList, err := clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
-	checkErr(err)
+	if recordedSnapshot != nil {
+		recordedSnapshot.PodMetrics = append(recordedSnapshot.PodMetrics, podMetricsList.Items...)
+	}
 
-	return *nodeList
+	return podMetricsList, nil
 }
 
-// Get a list of all or namespaced pods in the cluster
-// Deployment Name may be specified or not
-func getPodList(params ...string) v1.PodList {
-	clientset := getMetaV1Clientset()
-	namespace := checkVariadic(params, 0)
-	deploymentName := checkVariadic(params, 1)
+// Clientsets are created once and shared, probes may ask for them while informers are started
+var (
+	metaV1Clientset     *kubernetes.Clientset
+	metaV1ClientsetErr  error
+	metaV1ClientsetOnce sync.Once
 
-	podList, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
-	checkErr(err)
+	metricsClientset     *metricsv.Clientset
+	metricsClientsetErr  error
+	metricsClientsetOnce sync.Once
 
-	// Return only pods with the correct Deployment Name
-	if deploymentName != "" {
-		var tmpPodList []v1.Pod
+	dynamicClient     dynamic.Interface
+	dynamicClientErr  error
+	dynamicClientOnce sync.Once
+)
 
-		for _, pod := range podList.Items {
-			if strings.HasPrefix(pod.Name, deploymentName) {
-				tmpPodList = append(tmpPodList, pod)
-			}
+func getMetaV1Clientset(apiVersion ...string) (*kubernetes.Clientset, error) {
+	metaV1ClientsetOnce.Do(func() {
+		config, err := getRestConfig()
+		if err != nil {
+			metaV1ClientsetErr = fmt.Errorf("cannot build kubernetes client config: %w", err)
+			return
 		}
 
-		podList.Items = tmpPodList
-	}
-
-	return *podList
-}
-
-func getPodMetricsList(namespace ...string) v1beta1.PodMetricsList {
-	clientset := getMetricsClientset()
-	actualNamespace := checkVariadic(namespace)
-	podMetricsList, err := clientset.MetricsV1beta1().PodMetricses(actualNamespace).List(context.TODO(), metav1.ListOptions{})
-	checkErr(err)
+		metaV1Clientset, metaV1ClientsetErr = kubernetes.NewForConfig(config)
+	})
 
-	return *podMetricsList
+	return metaV1Clientset, metaV1ClientsetErr
 }
 
-func getDeploymentList(namespace ...string) appsV1.DeploymentList {
-	clientset := getMetaV1Clientset()
-	actualNamespace := checkVariadic(namespace)
+func getMetricsClientset(apiVersion ...string) (*metricsv.Clientset, error) {
+	metricsClientsetOnce.Do(func() {
+		config, err := getRestConfig()
+		if err != nil {
+			metricsClientsetErr = fmt.Errorf("cannot build kubernetes client config: %w", err)
+			return
+		}
 
-	deploymentList, err := clientset.AppsV1().Deployments(actualNamespace).List(context.TODO(), metav1.ListOptions{})
-	checkErr(err)
+		metricsClientset, metricsClientsetErr = metricsv.NewForConfig(config)
+	})
 
-	return *deploymentList
+	return metricsClientset, metricsClientsetErr
 }
 
-func getMetaV1Clientset(apiVersion ...string) *kubernetes.Clientset {
-	config, err := rest.InClusterConfig()
-	checkErr(err)
+func getDynamicClient() (dynamic.Interface, error) {
+	dynamicClientOnce.Do(func() {
+		config, err := getRestConfig()
+		if err != nil {
+			dynamicClientErr = fmt.Errorf("cannot build kubernetes client config: %w", err)
+			return
+		}
 
-	clientset, err := kubernetes.NewForConfig(config)
-	checkErr(err)
+		dynamicClient, dynamicClientErr = dynamic.NewForConfig(config)
+	})
 
-	return clientset
+	return dynamicClient, dynamicClientErr
 }
 
-func getMetricsClientset(apiVersion ...string) *metricsv.Clientset {
-	config, err := rest.InClusterConfig()
-	checkErr(err)
+// Build REST config from kubeconfig (--kubeconfig flag or KUBECONFIG env) and fall back to in-cluster config
+func getRestConfig() (*rest.Config, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeconfigPath != "" {
+		loadingRules.ExplicitPath = kubeconfigPath
+	}
 
-	clientset, err := metricsv.NewForConfig(config)
-	checkErr(err)
+	// Without an explicit kubeconfig or context we are most likely running inside the cluster
+	if kubeconfigPath == "" && os.Getenv(clientcmd.RecommendedConfigPathEnvVar) == "" && kubeContext == "" {
+		config, err := rest.InClusterConfig()
+		if err == nil {
+			return config, nil
+		}
+		logK8s.Info("in-cluster config is not available, trying default kubeconfig", "err", err)
+	}
 
-	return clientset
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
 }
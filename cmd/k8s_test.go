@@ -0,0 +1,196 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/metrics/pkg/apis/metrics/v1beta1"
+)
+
+var containerRestartPolicyAlways = v1.ContainerRestartPolicyAlways
+
+func newContainer(name, cpu string) v1.Container {
+	container := v1.Container{Name: name}
+	if cpu != "" {
+		container.Resources.Requests = v1.ResourceList{v1.ResourceCPU: resource.MustParse(cpu)}
+	}
+	return container
+}
+
+func newSidecar(name, cpu string) v1.Container {
+	container := newContainer(name, cpu)
+	container.RestartPolicy = &containerRestartPolicyAlways
+	return container
+}
+
+func TestGetPodRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		podSpec v1.PodSpec
+		wantCPU int64
+	}{
+		{
+			name:    "containers are summed",
+			podSpec: v1.PodSpec{Containers: []v1.Container{newContainer("app", "200m"), newContainer("proxy", "100m")}},
+			wantCPU: 300,
+		},
+		{
+			name:    "no requests",
+			podSpec: v1.PodSpec{Containers: []v1.Container{newContainer("app", "")}},
+			wantCPU: 0,
+		},
+		{
+			name: "largest init container wins",
+			podSpec: v1.PodSpec{
+				InitContainers: []v1.Container{newContainer("migrate", "500m"), newContainer("warmup", "100m")},
+				Containers:     []v1.Container{newContainer("app", "200m")},
+			},
+			wantCPU: 500,
+		},
+		{
+			name: "app containers win",
+			podSpec: v1.PodSpec{
+				InitContainers: []v1.Container{newContainer("migrate", "100m")},
+				Containers:     []v1.Container{newContainer("app", "200m")},
+			},
+			wantCPU: 200,
+		},
+		{
+			name: "sidecar runs along with app containers",
+			podSpec: v1.PodSpec{
+				InitContainers: []v1.Container{newSidecar("mesh", "100m")},
+				Containers:     []v1.Container{newContainer("app", "200m")},
+			},
+			wantCPU: 300,
+		},
+		{
+			name: "sidecar started before init container",
+			podSpec: v1.PodSpec{
+				InitContainers: []v1.Container{newSidecar("mesh", "100m"), newContainer("migrate", "500m")},
+				Containers:     []v1.Container{newContainer("app", "200m")},
+			},
+			wantCPU: 600,
+		},
+		{
+			name: "sidecar started after init container",
+			podSpec: v1.PodSpec{
+				InitContainers: []v1.Container{newContainer("migrate", "500m"), newSidecar("mesh", "100m")},
+				Containers:     []v1.Container{newContainer("app", "200m")},
+			},
+			wantCPU: 500,
+		},
+		{
+			name: "init container without requests after sidecar",
+			podSpec: v1.PodSpec{
+				InitContainers: []v1.Container{newSidecar("mesh", "100m"), newContainer("migrate", "")},
+				Containers:     []v1.Container{newContainer("app", "200m")},
+			},
+			wantCPU: 300,
+		},
+		{
+			name: "overhead is added",
+			podSpec: v1.PodSpec{
+				InitContainers: []v1.Container{newContainer("migrate", "500m")},
+				Containers:     []v1.Container{newContainer("app", "200m")},
+				Overhead:       v1.ResourceList{v1.ResourceCPU: resource.MustParse("50m")},
+			},
+			wantCPU: 550,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := getPodRequests(&test.podSpec)
+			if got.Cpu().MilliValue() != test.wantCPU {
+				t.Errorf("getPodRequests() cpu = %dm, want %dm", got.Cpu().MilliValue(), test.wantCPU)
+			}
+		})
+	}
+}
+
+func TestGetNodeReallyOccupiedResources(t *testing.T) {
+	newPod := func(name string, phase v1.PodPhase) v1.Pod {
+		return v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: name},
+			Spec:       v1.PodSpec{NodeName: "node-1", Containers: []v1.Container{newContainer("app", "100m")}},
+			Status:     v1.PodStatus{Phase: phase},
+		}
+	}
+
+	podList := &v1.PodList{Items: []v1.Pod{
+		newPod("running", v1.PodRunning),
+		newPod("pending", v1.PodPending),
+		newPod("succeeded", v1.PodSucceeded),
+		newPod("failed", v1.PodFailed),
+	}}
+
+	got := getNodeReallyOccupiedResources(&configType{}, "node-1", podList, &v1beta1.PodMetricsList{})
+	if got[v1.ResourceCPU] != 200 {
+		t.Errorf("getNodeReallyOccupiedResources() cpu = %dm, want 200m", got[v1.ResourceCPU])
+	}
+}
+
+func TestTaintIsTolerated(t *testing.T) {
+	taint := v1.Taint{Key: "dedicated", Value: "db", Effect: v1.TaintEffectNoSchedule}
+
+	tests := []struct {
+		name        string
+		tolerations []v1.Toleration
+		want        bool
+	}{
+		{"no tolerations", nil, false},
+		{"equal", []v1.Toleration{{Key: "dedicated", Operator: v1.TolerationOpEqual, Value: "db", Effect: v1.TaintEffectNoSchedule}}, true},
+		{"empty operator means equal", []v1.Toleration{{Key: "dedicated", Value: "db"}}, true},
+		{"other value", []v1.Toleration{{Key: "dedicated", Operator: v1.TolerationOpEqual, Value: "web"}}, false},
+		{"other key", []v1.Toleration{{Key: "team", Operator: v1.TolerationOpExists}}, false},
+		{"exists", []v1.Toleration{{Key: "dedicated", Operator: v1.TolerationOpExists}}, true},
+		{"empty key with exists tolerates everything", []v1.Toleration{{Operator: v1.TolerationOpExists}}, true},
+		{"empty key with equal", []v1.Toleration{{Operator: v1.TolerationOpEqual, Value: "db"}}, true},
+		{"effect mismatch", []v1.Toleration{{Key: "dedicated", Operator: v1.TolerationOpExists, Effect: v1.TaintEffectNoExecute}}, false},
+		{"empty effect matches any effect", []v1.Toleration{{Key: "dedicated", Operator: v1.TolerationOpExists}}, true},
+		{"second toleration matches", []v1.Toleration{{Key: "team", Operator: v1.TolerationOpExists}, {Key: "dedicated", Value: "db"}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := taintIsTolerated(&taint, test.tolerations)
+			if got != test.want {
+				t.Errorf("taintIsTolerated() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNodeIsTainted(t *testing.T) {
+	tests := []struct {
+		name        string
+		taints      []v1.Taint
+		tolerations []v1.Toleration
+		want        bool
+	}{
+		{"no taints", nil, nil, false},
+		{"prefer no schedule is ignored", []v1.Taint{{Key: "spot", Effect: v1.TaintEffectPreferNoSchedule}}, nil, false},
+		{"no schedule", []v1.Taint{{Key: "spot", Effect: v1.TaintEffectNoSchedule}}, nil, true},
+		{"no execute", []v1.Taint{{Key: "spot", Effect: v1.TaintEffectNoExecute}}, nil, true},
+		{"tolerated", []v1.Taint{{Key: "spot", Effect: v1.TaintEffectNoSchedule}}, []v1.Toleration{{Key: "spot", Operator: v1.TolerationOpExists}}, false},
+		{
+			name:        "one of two taints is not tolerated",
+			taints:      []v1.Taint{{Key: "spot", Effect: v1.TaintEffectNoSchedule}, {Key: "gpu", Effect: v1.TaintEffectNoSchedule}},
+			tolerations: []v1.Toleration{{Key: "spot", Operator: v1.TolerationOpExists}},
+			want:        true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			workload := &workloadType{PodSpec: v1.PodSpec{Tolerations: test.tolerations}}
+
+			got := nodeIsTainted(workload, test.taints)
+			if got != test.want {
+				t.Errorf("nodeIsTainted() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	defaultLogFormat = "logfmt"
+	defaultLogLevel  = "info"
+
+	subsystemMain       = "main"
+	subsystemK8s        = "k8s"
+	subsystemPrometheus = "prometheus"
+	subsystemCalc       = "calc"
+)
+
+// Every subsystem has its own level, so e.g. calc tracing can be enabled alone
+var (
+	logLevels = map[string]*slog.LevelVar{
+		subsystemMain:       new(slog.LevelVar),
+		subsystemK8s:        new(slog.LevelVar),
+		subsystemPrometheus: new(slog.LevelVar),
+		subsystemCalc:       new(slog.LevelVar),
+	}
+
+	logMain = newLogger(os.Stderr, defaultLogFormat, subsystemMain)
+	logK8s  = newLogger(os.Stderr, defaultLogFormat, subsystemK8s)
+	logProm = newLogger(os.Stderr, defaultLogFormat, subsystemPrometheus)
+	logCalc = newLogger(os.Stderr, defaultLogFormat, subsystemCalc)
+)
+
+// Configure log format (logfmt or json) and levels
+// Levels are set as "<default level>[,<subsystem>=<level>...]", e.g. "warn,calc=debug"
+func setupLogging(format, levels string) error {
+	if format != "logfmt" && format != "json" {
+		return fmt.Errorf("unknown log format %q, must be logfmt or json", format)
+	}
+
+	for _, levelSetting := range strings.Split(levels, ",") {
+		levelSetting = strings.TrimSpace(levelSetting)
+		if levelSetting == "" {
+			continue
+		}
+
+		subsystem, levelName, hasSubsystem := strings.Cut(levelSetting, "=")
+		if !hasSubsystem {
+			levelName = subsystem
+		}
+
+		var level slog.Level
+		err := level.UnmarshalText([]byte(levelName))
+		if err != nil {
+			return fmt.Errorf("cannot parse log level %q: %w", levelSetting, err)
+		}
+
+		if !hasSubsystem {
+			for _, levelVar := range logLevels {
+				levelVar.Set(level)
+			}
+			continue
+		}
+
+		levelVar, exists := logLevels[subsystem]
+		if !exists {
+			return fmt.Errorf("unknown log subsystem %q", subsystem)
+		}
+		levelVar.Set(level)
+	}
+
+	logMain = newLogger(os.Stderr, format, subsystemMain)
+	logK8s = newLogger(os.Stderr, format, subsystemK8s)
+	logProm = newLogger(os.Stderr, format, subsystemPrometheus)
+	logCalc = newLogger(os.Stderr, format, subsystemCalc)
+
+	return nil
+}
+
+func newLogger(output io.Writer, format, subsystem string) *slog.Logger {
+	var handler slog.Handler
+	options := &slog.HandlerOptions{Level: logLevels[subsystem]}
+
+	if format == "json" {
+		handler = slog.NewJSONHandler(output, options)
+	} else {
+		handler = slog.NewTextHandler(output, options)
+	}
+
+	return slog.New(handler).With("subsystem", subsystem)
+}
+
+// Return value of the environment variable or the default one
+func getEnv(name, defaultValue string) string {
+	value, exists := os.LookupEnv(name)
+	if !exists {
+		return defaultValue
+	}
+	return value
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
 	"time"
 
-	promapi "github.com/prometheus/client_golang/api"
 	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/spf13/pflag"
 	"gopkg.in/yaml.v3"
@@ -17,11 +18,21 @@ import (
 
 const (
 	defaultConfigPath             = "/app/config.yaml"
-	DEBUG                         = true // TODO: read DEBUG var from ENV
 	prometheusDefaultTimeout      = 10
 	exporterNamespace             = "capacity"
 	exporterDefaultPort           = 9301
 	exporterDefaultScrapeInterval = 60
+	nodeResourcesAllocatable      = "allocatable"
+	nodeResourcesCapacity         = "capacity"
+	defaultNodePool               = "default"
+)
+
+// Subcommands, the exporter is served without a subcommand
+const (
+	commandServe    = ""
+	commandValidate = "validate"
+	commandReport   = "report"
+	commandSnapshot = "snapshot"
 )
 
 type configType struct {
@@ -29,23 +40,81 @@ type configType struct {
 		Address       string
 		Timeout       int64
 		QueryTemplate string `yaml:"query_template"`
+
+		Auth struct {
+			Basic struct {
+				Username     string
+				Password     string
+				PasswordFile string `yaml:"password_file"`
+			}
+			BearerTokenFile string `yaml:"bearer_token_file"`
+		}
+		TLS struct {
+			CAFile             string `yaml:"ca_file"`
+			CertFile           string `yaml:"cert_file"`
+			KeyFile            string `yaml:"key_file"`
+			ServerName         string `yaml:"server_name"`
+			InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+		}
+		// Added to every request, e.g. X-Scope-OrgID
+		Headers map[string]string
+
+		// instant (default) or range: RPS is aggregated over the lookback window
+		RPSMode        string `yaml:"rps_mode"`
+		RPSAggregation string `yaml:"rps_aggregation"`
+		RPSLookback    string `yaml:"rps_lookback"`
+		RPSStep        string `yaml:"rps_step"`
 	}
 
 	Exporter struct {
 		Host            string
 		Port            int64
 		MetricsEndpoint string `yaml:"metrics_endpoint"`
+		ScrapeInterval  int64  `yaml:"scrape_interval"`
 	}
 
+	// Optional, limits node affinity evaluation to the listed keys and operators
 	Affinity []struct {
 		Key      string
 		Value    string
 		Operator v1.NodeSelectorOperator
 	}
 
+	// Source of used resources: metrics-server (default, point-in-time) or prometheus (percentile over a window)
+	Usage struct {
+		Source     string
+		Window     string
+		Resolution string
+		Percentile float64
+		// Optional full queries with %[1]v quantile, %[2]s window, %[3]s resolution (and %[4]s rate window for cpu)
+		CPUQuery    string `yaml:"cpu_query"`
+		MemoryQuery string `yaml:"memory_query"`
+	}
+
+	// Resources to calculate capacity for, cpu and memory by default
+	Resources []v1.ResourceName
+
+	// Node resources to count: allocatable (default) or capacity
+	NodeResources string `yaml:"node_resources"`
+	NodePoolLabel string `yaml:"node_pool_label"`
+
 	AllDeploymentsPrefix string `yaml:"all_deployments_prefix"`
 	AllDeploymentsSuffix string `yaml:"all_deployments_suffix"`
 
+	// Projection of adjusted RPS from its history
+	Forecast struct {
+		Enabled     bool
+		History     string
+		Step        string
+		HorizonDays int64 `yaml:"horizon_days"`
+		Seasonality string
+	}
+
+	// What-if traffic scenarios for report --scenario
+	Scenarios []scenarioType
+
+	Version string `yaml:"-"`
+
 	Namespaces []struct {
 		Name                         string
 		Frontend                     bool
@@ -55,23 +124,30 @@ type configType struct {
 		DeploymentAlias              string   `yaml:"deployment_alias"`
 		DeploymentPrefix             string   `yaml:"deployment_prefix"`
 		DeploymentSuffix             string   `yaml:"deployment_suffix"`
+		WorkloadKind                 string   `yaml:"workload_kind"`
 		DependsOn                    []string `yaml:"depends_on"`
-		DependsOnFullChain           []string
+		DependsOnFullChain           []string `yaml:"-"`
 		Prometheus                   struct {
 			QueryVariable     string `yaml:"query_variable"`
 			QueryFullOverride string `yaml:"query_full_override"`
+			RPSAggregation    string `yaml:"rps_aggregation"`
 		}
 	}
 }
 
-type deploymentLabelsType struct {
-	Allowed   []allowedAndForbiddenLabelsType
-	Forbidden []allowedAndForbiddenLabelsType
+type nodeFreeResourcesType struct {
+	Name      string        `json:"name"`
+	Resources resourcesType `json:"free"`
+	Pods      int64         `json:"free_pods"`
+	// Node fits at least one pod of the app, only such nodes are summed into free resources
+	Counted bool `json:"counted"`
 }
 
-type allowedAndForbiddenLabelsType struct {
-	Key    string
-	Values []string
+type nodePoolResourcesType struct {
+	AllocatableCPU    int64 `json:"allocatable_cpu"`
+	AllocatableMemory int64 `json:"allocatable_mem"`
+	CapacityCPU       int64 `json:"capacity_cpu"`
+	CapacityMemory    int64 `json:"capacity_mem"`
 }
 
 type promQueryParamsType struct {
@@ -80,150 +156,94 @@ type promQueryParamsType struct {
 }
 
 func main() {
-	var allowedNodes []string
-
-	freeCPU := make(map[string]int64)
-	freeMemory := make(map[string]int64)
-	allocatableCPU := make(map[string]int64)
-	allocatableMemory := make(map[string]int64)
-	deploymentRequestedCPU := make(map[string]int64)
-	deploymentRequestedMemory := make(map[string]int64)
-	usedCPU := make(map[string]int64)
-	usedMemory := make(map[string]int64)
-	reallyOccupiedCPU := make(map[string]int64)
-	reallyOccupiedMemory := make(map[string]int64)
-	fullChainCPU := make(map[string]int64)
-	fullChainMemory := make(map[string]int64)
-	rawRPS := make(map[string]int64)
-	adjustedRPS := make(map[string]int64)
-	podsAmount := make(map[string]int)
-	clusterCanHandleAdditionalPods := make(map[string]int64)
-	oneRPSCostCPU := make(map[string]float64)
-	oneRPSCostMemory := make(map[string]float64)
-
-	metricRPSCostCPU := make(map[string]prometheus.Gauge)
-	metricRPSCostMemory := make(map[string]prometheus.Gauge)
-	metricPodAmount := make(map[string]prometheus.Gauge)
-	metricClusterCanHandleAdditionalPods := make(map[string]prometheus.Gauge)
-	metricRawRPS := make(map[string]prometheus.Gauge)
-	metricAdjustedRPS := make(map[string]prometheus.Gauge)
-	metricFreeCPU := make(map[string]prometheus.Gauge)
-	metricFreeMemory := make(map[string]prometheus.Gauge)
-	metricAllocatableCPU := make(map[string]prometheus.Gauge)
-	metricAllocatableMemory := make(map[string]prometheus.Gauge)
-
-	config := readConfig()
-
-	// Create Prometheus metrics
-	for _, app := range getAllNamespaces(&config) {
-		labels := map[string]string{"app": app}
-
-		metricRPSCostCPU[app] = createGauge("rps_cost_cpu", "How many milliCPUs costs one RPS", labels)
-		metricRPSCostMemory[app] = createGauge("rps_cost_mem", "How many Memory bytes costs one RPS", labels)
-		metricPodAmount[app] = createGauge("pod_amount", "Current amount of pods", labels)
-		metricClusterCanHandleAdditionalPods[app] = createGauge("cluster_can_handle_additional_pods", "How many additional pods can the current cluster handle", labels)
-		metricRawRPS[app] = createGauge("rps_raw", "Raw RPS from Prometheus", labels)
-		metricAdjustedRPS[app] = createGauge("rps_adjusted", "Adjusted RPS with multipliers from config", labels)
-		metricFreeCPU[app] = createGauge("free_cpu", "MilliCPUs available for the app", labels)
-		metricFreeMemory[app] = createGauge("free_mem", "Memory bytes available for the app", labels)
-		metricAllocatableCPU[app] = createGauge("allocatable_cpu", "Total allocatable MilliCPUs for the app", labels)
-		metricAllocatableMemory[app] = createGauge("allocatable_mem", "Total allocatable Memory bytes for the app", labels)
-	}
-
-	go func() {
-		for {
-			nodeList := getNodeList()
-			podList := getPodList()
-			podMetricsList := getPodMetricsList()
-
-			for nsNum, namespace := range config.Namespaces {
-				nsName := namespace.Name
-
-				deploymentName := getDeploymentName(&config, nsName)
-				deploymentLabels := getAntiAffinityLabels(&config, nsName, deploymentName)
-				printDebug("Namespace: \"%s\"\nAllowed labels: %+v\nForbidden labels: %+v\n", nsName, deploymentLabels.Allowed, deploymentLabels.Forbidden)
-
-				deploymentRequestedCPU[nsName], deploymentRequestedMemory[nsName] = getDeploymentRequestedResources(nsName, deploymentName)
-				printDebug("Deployment Requested MilliCpuSum: %+v\nDeployment Requested MemSum: %+v\n", deploymentRequestedCPU[nsName], deploymentRequestedMemory[nsName])
-
-				podsAmount[nsName] = len(getPodList(nsName, deploymentName).Items)
-				printDebug("Amount of pods: %+v\n", podsAmount[nsName])
-
-				usedCPU[nsName], usedMemory[nsName] = getUsedResources(nsName, deploymentName)
-				printDebug("Used MilliCpuSum: %+v\nUsed MemSum: %+v\n", usedCPU[nsName], usedMemory[nsName])
-
-				reallyOccupiedCPU[nsName], reallyOccupiedMemory[nsName] = calculateReallyOccupiedResources(usedCPU[nsName], usedMemory[nsName], deploymentRequestedCPU[nsName], deploymentRequestedMemory[nsName])
-				printDebug("Really Occupied MilliCpuSum: %+v\nReally Occupied MemSum: %+v\n", reallyOccupiedCPU[nsName], reallyOccupiedMemory[nsName])
-
-				freeCPU[nsName], freeMemory[nsName], allocatableCPU[nsName], allocatableMemory[nsName], allowedNodes = getFreeResources(nsName, deploymentName, deploymentLabels, &nodeList, &podList, &podMetricsList, reallyOccupiedCPU[nsName], reallyOccupiedMemory[nsName], podsAmount[nsName])
-				printDebug("Free MilliCpuSum (for namespace \"%+v\"): %+v\nFree MemSum (for namespace \"%+v\"): %+v\nAllowed nodes: %+v\n", nsName, freeCPU[nsName], nsName, freeMemory[nsName], allowedNodes)
-
-				config.Namespaces[nsNum].DependsOnFullChain = getDependencies(&config, nsName)
-				printDebug("Dependencies: %+v\n", config.Namespaces[nsNum].DependsOnFullChain)
-
-				rawRPS[nsName] = getRPS(&config, nsName)
-				printDebug("Raw RPS: %+v\n", rawRPS[nsName])
-
-				adjustedRPS[nsName] = adjustRPS(&config, nsName, rawRPS[nsName])
-				printDebug("Adjusted RPS: %+v\n", adjustedRPS[nsName])
-
-				printDebug("\n")
-			}
+	command := getCommand()
+	configPath := parseFlags()
+
+	switch command {
+	case commandValidate:
+		os.Exit(runValidate(configPath))
+	case commandReport:
+		checkErr(checkReportOutput())
+	}
 
-			printDebug("\n###### FINAL CALCULATIONS! ######\n\n")
-			ingressMultipliers := calculateIngressMultipliers(&config, adjustedRPS)
-			printDebug("Ingress multipliers: %+v\n\n", ingressMultipliers)
+	var config *configType
+	var err error
 
-			for _, namespace := range config.Namespaces {
-				nsName := namespace.Name
-				printDebug("Namespace: \"%s\"\n", nsName)
+	if fromSnapshotPath != "" {
+		replayedSnapshot, err = readSnapshot(fromSnapshotPath)
+		checkErr(err)
+	}
 
-				fullChainCPU[nsName], fullChainMemory[nsName] = calculateFullChainResources(&config, nsName, reallyOccupiedCPU, reallyOccupiedMemory, ingressMultipliers)
-				printDebug("Full Chain MilliCpuSum: %+v\nFull Chain MemSum: %+v\n", fullChainCPU[nsName], fullChainMemory[nsName])
+	if configFromSnapshot() {
+		config, err = parseConfig([]byte(replayedSnapshot.Config), fromSnapshotPath)
+	} else {
+		config, err = readConfig(configPath)
+	}
+	checkErr(err)
+	currentConfig.Store(config)
 
-				clusterCanHandleAdditionalPods[nsName] = calculateClusterCanHandlePods(freeCPU[nsName], freeMemory[nsName], fullChainCPU[nsName], fullChainMemory[nsName], podsAmount[nsName])
-				printDebug("Cluster can handle %+v additional pods\n", clusterCanHandleAdditionalPods[nsName])
+	stopCh := make(chan struct{})
+	defer close(stopCh)
 
-				oneRPSCostCPU[nsName], oneRPSCostMemory[nsName] = calculateOneRPSCost(fullChainCPU[nsName], fullChainMemory[nsName], adjustedRPS[nsName])
-				printDebug("One RPS costs: %+v MilliCPU, %+v Memory (bytes)\n", oneRPSCostCPU[nsName], oneRPSCostMemory[nsName])
+	createMetrics(config)
 
-				printDebug("\n")
+	// Probes answer while informer caches are synced, /readyz is not ready until the first cycle is done
+	if command == commandServe {
+		go serveExporter(config)
+	}
 
-				// Set Prometheus metrics
-				metricRPSCostCPU[nsName].Set(oneRPSCostCPU[nsName])
-				metricRPSCostMemory[nsName].Set(oneRPSCostMemory[nsName])
-				metricPodAmount[nsName].Set(float64(podsAmount[nsName]))
-				metricClusterCanHandleAdditionalPods[nsName].Set(float64(clusterCanHandleAdditionalPods[nsName]))
-				metricRawRPS[nsName].Set(float64(rawRPS[nsName]))
-				metricAdjustedRPS[nsName].Set(float64(adjustedRPS[nsName]))
-				metricFreeCPU[nsName].Set(float64(freeCPU[nsName]))
-				metricFreeMemory[nsName].Set(float64(freeMemory[nsName]))
-				metricAllocatableCPU[nsName].Set(float64(allocatableCPU[nsName]))
-				metricAllocatableMemory[nsName].Set(float64(allocatableMemory[nsName]))
-			}
+	if replayedSnapshot != nil {
+		err = startSnapshotListers(replayedSnapshot)
+	} else {
+		err = startInformers(stopCh, workloadKindUsed(config, workloadKindRollout))
+	}
+	checkErr(err)
+	exporterStatus.markStarted()
 
-			// TODO: read exporterScrapeInterval from config
-			time.Sleep(exporterDefaultScrapeInterval * time.Second)
+	switch command {
+	case commandReport:
+		os.Exit(runReport(config))
+	case commandSnapshot:
+		os.Exit(runSnapshot(config, configPath))
+	}
 
-		}
-	}()
+	reloadCh := make(chan *configType)
+	if !configFromSnapshot() {
+		go watchConfig(configPath, reloadCh)
+	}
 
-	serveExporter(&config)
+	for {
+		config := currentConfig.Load()
 
+		snapshot := runCollectionCycle(config)
+		publishMetrics(config, snapshot)
+
+		latestSnapshot.Store(snapshot)
+		exporterStatus.finishCycle(config, snapshot)
+
+		// New config is applied between cycles and the next cycle starts right away
+		select {
+		case newConfig := <-reloadCh:
+			applyConfig(config, newConfig)
+		case <-time.After(getScrapeInterval(config)):
+		}
+	}
 }
 
 // Get Requests Per Second for the specified namespace (from Prometheus)
-func getRPS(config *configType, namespace string) int64 {
+func getRPS(config *configType, namespace string) (int64, error) {
 
-	promAddress := config.Prometheus.Address
 	promQuery := parsePromQuery(config, namespace)
 
-	promResponse := promRequest(promAddress, promQuery)
+	promResponse, err := promRequest(config, promQuery)
+	if err != nil {
+		return 0, err
+	}
 
 	if len(promResponse) == 0 {
-		return 0
+		return 0, nil
 	}
-	return int64(promResponse[0])
+	return int64(promResponse[0]), nil
 }
 
 func parsePromQuery(config *configType, targetNamespace string) string {
@@ -244,11 +264,35 @@ func parsePromQuery(config *configType, targetNamespace string) string {
 }
 
 // Get values for the provided Prometheus query
-func promRequest(address, query string, params ...promQueryParamsType) []float64 {
-	var actualParams promQueryParamsType
+func promRequest(config *configType, query string, params ...promQueryParamsType) ([]float64, error) {
 	var response []float64
 
-	printDebug("Prom query: %s\n", query)
+	vectorResult, err := promVectorRequest(config, query, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, currentResult := range vectorResult {
+		response = append(response, float64(currentResult.Value))
+	}
+
+	logProm.Debug("response", "query", query, "response", response)
+	return response, nil
+}
+
+// Get samples (values with labels) for the provided Prometheus query
+func promVectorRequest(config *configType, query string, params ...promQueryParamsType) (model.Vector, error) {
+	var actualParams promQueryParamsType
+
+	logProm.Debug("query", "query", query)
+
+	if replayedSnapshot != nil {
+		vectorResult, err := getSnapshotPromResult(query)
+		if err == nil && recordedSnapshot != nil {
+			recordedSnapshot.PrometheusResults[query] = vectorResult
+		}
+		return vectorResult, err
+	}
 
 	if len(params) == 0 {
 		actualParams.PromTimeout = prometheusDefaultTimeout * time.Second
@@ -269,36 +313,81 @@ func promRequest(address, query string, params ...promQueryParamsType) []float64
 
 	}
 
-	client, err := promapi.NewClient(promapi.Config{Address: address})
-	checkErr(err)
+	v1api, err := getPromAPI(config)
+	if err != nil {
+		return nil, err
+	}
 
-	v1api := promv1.NewAPI(client)
 	ctx, cancel := context.WithTimeout(context.Background(), actualParams.PromTimeout)
 	defer cancel()
 
 	result, warnings, err := v1api.Query(ctx, query, actualParams.QueryTime)
-	checkErr(err)
+	if err != nil {
+		return nil, fmt.Errorf("Prometheus query %q failed: %w", query, err)
+	}
 
 	if len(warnings) > 0 {
-		printDebug("Prometheus warnings: %v\n", warnings)
+		logProm.Warn("query returned warnings", "query", query, "warnings", warnings)
 	}
 
 	vectorResult, isVector := result.(model.Vector)
-	if isVector {
-		for _, currentResult := range vectorResult {
-			response = append(response, float64(currentResult.Value))
+	if !isVector {
+		return nil, fmt.Errorf("Prometheus query %q returned %s instead of vector", query, result.Type())
+	}
+
+	if recordedSnapshot != nil {
+		recordedSnapshot.PrometheusResults[query] = vectorResult
+	}
+
+	return vectorResult, nil
+}
+
+// Get series of the provided Prometheus query over the lookback window until now
+func promRangeRequest(config *configType, query string, lookback, step time.Duration) (model.Matrix, error) {
+	logProm.Debug("range query", "query", query, "lookback", lookback, "step", step)
+
+	if replayedSnapshot != nil {
+		matrixResult, err := getSnapshotPromRangeResult(query, lookback, step)
+		if err == nil && recordedSnapshot != nil {
+			recordedSnapshot.PrometheusRangeResults[getRangeQueryKey(query, lookback, step)] = matrixResult
 		}
-	} else {
-		// panic("Cannot get response from Prometheus for the following query:\n" + query)
-		printDebug("Cannot get response from Prometheus for the following query:\n%+v\n", query)
+		return matrixResult, err
 	}
 
-	printDebug("Prom response: %+v\n", response)
-	return response
+	v1api, err := getPromAPI(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), prometheusDefaultTimeout*time.Second)
+	defer cancel()
+
+	end := time.Now()
+	queryRange := promv1.Range{Start: end.Add(-lookback), End: end, Step: step}
+
+	result, warnings, err := v1api.QueryRange(ctx, query, queryRange)
+	if err != nil {
+		return nil, fmt.Errorf("Prometheus range query %q failed: %w", query, err)
+	}
+
+	if len(warnings) > 0 {
+		logProm.Warn("query returned warnings", "query", query, "warnings", warnings)
+	}
+
+	matrixResult, isMatrix := result.(model.Matrix)
+	if !isMatrix {
+		return nil, fmt.Errorf("Prometheus range query %q returned %s instead of matrix", query, result.Type())
+	}
+
+	if recordedSnapshot != nil {
+		recordedSnapshot.PrometheusRangeResults[getRangeQueryKey(query, lookback, step)] = matrixResult
+	}
+
+	return matrixResult, nil
 }
 
 // Gather all dependencies and sub-dependencies of one namespace
-func getDependencies(config *configType, suzerain string, suzerainList ...string) []string {
+func getDependencies(config *configType, suzerain string, suzerainList ...string) ([]string, error) {
 	var vassalList []string
 
 	suzerainList = append(suzerainList, suzerain)
@@ -308,23 +397,28 @@ func getDependencies(config *configType, suzerain string, suzerainList ...string
 		if currentNamespace.Name == suzerain {
 			for _, vassal := range currentNamespace.DependsOn {
 				if inList(vassal, suzerainList) {
-					panic("Dependency loop detected!")
+					return nil, fmt.Errorf("dependency loop detected: %s -> %s", strings.Join(suzerainList, " -> "), vassal)
 				}
 
 				if !inList(vassal, allNamespaces) {
-					panic("Found undescribed dependency: " + vassal)
+					return nil, fmt.Errorf("found undescribed dependency: %s", vassal)
+				}
+
+				subVassalList, err := getDependencies(config, vassal, suzerainList...)
+				if err != nil {
+					return nil, err
 				}
 
 				vassalList = append(vassalList, vassal)
-				vassalList = append(vassalList, getDependencies(config, vassal, suzerainList...)...)
+				vassalList = append(vassalList, subVassalList...)
 			}
 		}
 	}
 
-	return vassalList
+	return vassalList, nil
 }
 
-// Combine deployment name from prefix, suffix and namespace name (or alias)
+// Combine workload name from prefix, suffix and namespace name (or alias)
 func getDeploymentName(config *configType, targetNamespace string) string {
 	var baseName, prefix, suffix string
 
@@ -362,6 +456,33 @@ func getDeploymentName(config *configType, targetNamespace string) string {
 	return finalName
 }
 
+func getScrapeInterval(config *configType) time.Duration {
+	if config.Exporter.ScrapeInterval == 0 {
+		return exporterDefaultScrapeInterval * time.Second
+	}
+	return time.Duration(config.Exporter.ScrapeInterval) * time.Second
+}
+
+// Get kind of the namespace's workload, Deployment by default
+func getWorkloadKind(config *configType, targetNamespace string) string {
+	for _, currentNamespace := range config.Namespaces {
+		if currentNamespace.Name == targetNamespace && currentNamespace.WorkloadKind != "" {
+			return strings.ToLower(currentNamespace.WorkloadKind)
+		}
+	}
+	return workloadKindDeployment
+}
+
+// Check if any namespace uses the specified workload kind
+func workloadKindUsed(config *configType, kind string) bool {
+	for _, namespace := range config.Namespaces {
+		if getWorkloadKind(config, namespace.Name) == kind {
+			return true
+		}
+	}
+	return false
+}
+
 func getAllNamespaces(config *configType) []string {
 	var namespaceList []string
 
@@ -371,19 +492,73 @@ func getAllNamespaces(config *configType) []string {
 	return namespaceList
 }
 
-func readConfig() configType {
-	// Parse a config flag
+// Take the subcommand out of the arguments, so flags can be parsed after it
+func getCommand() string {
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		return commandServe
+	}
+
+	command := os.Args[1]
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+
+	if !inList(command, []string{commandValidate, commandReport, commandSnapshot}) {
+		fmt.Fprintf(os.Stderr, "unknown command %q, available commands: %s, %s, %s\n", command, commandValidate, commandReport, commandSnapshot)
+		os.Exit(2)
+	}
+
+	return command
+}
+
+// Parse command line flags, set up logging and return the config path
+func parseFlags() string {
 	configPath := pflag.StringP("config", "c", defaultConfigPath, "Path to config file")
+	pflag.StringVar(&kubeconfigPath, "kubeconfig", "", "Path to kubeconfig file (KUBECONFIG env is used if empty, in-cluster config otherwise)")
+	pflag.StringVar(&kubeContext, "context", "", "Kubeconfig context to use (current context if empty)")
+	pflag.StringVarP(&reportOutput, "output", "o", reportOutputTable, "Output format of the report command: table, json or csv")
+	pflag.StringVar(&reportScenario, "scenario", "", "Scenario from the config for the report command to calculate instead of the current traffic")
+	pflag.StringVar(&snapshotPath, "snapshot-file", defaultSnapshotPath, "Path to the file written by the snapshot command")
+	pflag.DurationVar(&informerCacheSyncTimeout, "cache-sync-timeout", informerDefaultCacheSyncTimeout, "How long to wait for informer caches on startup before giving up")
+	pflag.StringVar(&fromSnapshotPath, "from-snapshot", "", "Read the cluster state and Prometheus results from the snapshot file instead of the cluster")
+	logFormat := pflag.String("log-format", getEnv("LOG_FORMAT", defaultLogFormat), "Log format: logfmt or json (LOG_FORMAT env)")
+	logLevel := pflag.String("log-level", getEnv("LOG_LEVEL", defaultLogLevel), "Log level, optionally per subsystem (main, k8s, prometheus, calc), e.g. \"warn,calc=debug\" (LOG_LEVEL env)")
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n  validate    Check the config and print all problems with line numbers\n  report      Run one collection cycle and print capacity of every app\n  snapshot    Run one collection cycle and write everything it has read to a file for --from-snapshot\n\nFlags:\n", os.Args[0])
+		pflag.PrintDefaults()
+	}
 	pflag.Parse()
 
-	configData, err := ioutil.ReadFile(*configPath)
+	err := setupLogging(*logFormat, *logLevel)
 	checkErr(err)
 
+	return *configPath
+}
+
+// Read, parse and validate the config file
+func readConfig(configPath string) (*configType, error) {
+	configData, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfig(configData, configPath)
+}
+
+func parseConfig(configData []byte, source string) (*configType, error) {
 	config := &configType{}
-	err = yaml.Unmarshal(configData, config)
-	checkErr(err)
+	err := yaml.Unmarshal(configData, config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse config %s: %w", source, err)
+	}
+
+	// Short hash of the config file to see which config is applied
+	config.Version = fmt.Sprintf("%x", sha256.Sum256(configData))[:12]
+
+	err = validateConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", source, err)
+	}
 
-	return *config
+	return config, nil
 }
 
 func checkVariadic(slice []string, elementNum ...int64) string {
@@ -414,30 +589,57 @@ func inList(variable string, list []string) bool {
 	return false
 }
 
-func printWithTabs(str string, indent int, printOutput ...bool) string {
-	tabs := "\t"
+// Remember the first error of the app and count it
+func failApp(appErrors map[string]error, app, source string, err error) {
+	logMain.Error("cannot collect data", "namespace", app, "source", source, "err", err)
+	metricScrapeErrors.WithLabelValues(app, source).Inc()
 
-	for i := 1; i < indent-len(str)/8; i++ {
-		tabs += "\t"
+	if _, exists := appErrors[app]; !exists {
+		appErrors[app] = err
 	}
+}
 
-	output := str + tabs
-
-	if len(printOutput) == 0 || printOutput[0] {
-		printDebug("%s", output)
+// Fail every app at once when cluster-wide inputs are missing
+func failAllApps(config *configType, appErrors map[string]error, source string, err error) {
+	for _, app := range getAllNamespaces(config) {
+		failApp(appErrors, app, source, err)
 	}
-	return output
 }
 
-func printDebug(line string, variable ...interface{}) {
-	if DEBUG {
-		fmt.Printf(line, variable...)
+// Check if the app, one of its dependencies or (for frontends) one of the other frontends failed
+func inputsFailed(config *configType, appErrors map[string]error, app string) bool {
+	if _, failed := appErrors[app]; failed {
+		return true
+	}
+
+	for _, currentNamespace := range config.Namespaces {
+		if currentNamespace.Name == app {
+			for _, dependantNamespace := range currentNamespace.DependsOnFullChain {
+				if _, failed := appErrors[dependantNamespace]; failed {
+					appErrors[app] = fmt.Errorf("dependency %s failed: %w", dependantNamespace, appErrors[dependantNamespace])
+					return true
+				}
+			}
+
+			// Ingress multipliers are calculated from RPS of all frontends
+			if currentNamespace.Frontend {
+				for _, otherNamespace := range config.Namespaces {
+					if _, failed := appErrors[otherNamespace.Name]; failed && otherNamespace.Frontend {
+						appErrors[app] = fmt.Errorf("frontend %s failed: %w", otherNamespace.Name, appErrors[otherNamespace.Name])
+						return true
+					}
+				}
+			}
+		}
 	}
+
+	return false
 }
 
+// Errors on startup are fatal
 func checkErr(err error) {
 	if err != nil {
-		// panic(err)
-		fmt.Println(err)
+		logMain.Error("fatal error", "err", err)
+		os.Exit(1)
 	}
 }
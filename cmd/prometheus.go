@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	promapi "github.com/prometheus/client_golang/api"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	promconfig "github.com/prometheus/common/config"
+)
+
+// One client is shared by all queries and rebuilt when the config is reloaded
+var (
+	promClientMutex  sync.Mutex
+	promClientConfig *configType
+	promAPI          promv1.API
+)
+
+// Add configured headers (e.g. X-Scope-OrgID for Thanos or Mimir) to every request
+type headersRoundTripperType struct {
+	headers map[string]string
+	next    http.RoundTripper
+}
+
+func (roundTripper *headersRoundTripperType) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+
+	for name, value := range roundTripper.headers {
+		request.Header.Set(name, value)
+	}
+
+	return roundTripper.next.RoundTrip(request)
+}
+
+// Get Prometheus API client for the config
+func getPromAPI(config *configType) (promv1.API, error) {
+	promClientMutex.Lock()
+	defer promClientMutex.Unlock()
+
+	if promAPI != nil && promClientConfig == config {
+		return promAPI, nil
+	}
+
+	httpClientConfig, err := getPromHTTPClientConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	roundTripper, err := promconfig.NewRoundTripperFromConfig(httpClientConfig, "capacity-exporter")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create Prometheus HTTP client: %w", err)
+	}
+
+	if len(config.Prometheus.Headers) > 0 {
+		roundTripper = &headersRoundTripperType{headers: config.Prometheus.Headers, next: roundTripper}
+	}
+
+	client, err := promapi.NewClient(promapi.Config{Address: config.Prometheus.Address, RoundTripper: roundTripper})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create Prometheus client: %w", err)
+	}
+
+	promAPI = promv1.NewAPI(client)
+	promClientConfig = config
+	logProm.Debug("Prometheus client is created", "address", config.Prometheus.Address)
+
+	return promAPI, nil
+}
+
+// Convert auth and tls sections of the config, password and bearer token files are reread on every request
+func getPromHTTPClientConfig(config *configType) (promconfig.HTTPClientConfig, error) {
+	httpClientConfig := promconfig.DefaultHTTPClientConfig
+	auth := config.Prometheus.Auth
+	tls := config.Prometheus.TLS
+
+	if auth.Basic.Username != "" || auth.Basic.Password != "" || auth.Basic.PasswordFile != "" {
+		httpClientConfig.BasicAuth = &promconfig.BasicAuth{
+			Username:     auth.Basic.Username,
+			Password:     promconfig.Secret(auth.Basic.Password),
+			PasswordFile: auth.Basic.PasswordFile,
+		}
+	}
+
+	if auth.BearerTokenFile != "" {
+		httpClientConfig.Authorization = &promconfig.Authorization{
+			Type:            "Bearer",
+			CredentialsFile: auth.BearerTokenFile,
+		}
+	}
+
+	httpClientConfig.TLSConfig = promconfig.TLSConfig{
+		CAFile:             tls.CAFile,
+		CertFile:           tls.CertFile,
+		KeyFile:            tls.KeyFile,
+		ServerName:         tls.ServerName,
+		InsecureSkipVerify: tls.InsecureSkipVerify,
+	}
+
+	err := httpClientConfig.Validate()
+	if err != nil {
+		return httpClientConfig, fmt.Errorf("invalid Prometheus client config: %w", err)
+	}
+
+	return httpClientConfig, nil
+}
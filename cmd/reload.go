@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// Editors and ConfigMap updates change files in several steps, the config is read when they settle
+	configReloadDebounce = 2 * time.Second
+	// ConfigMap volumes swap this symlink to update all files at once
+	configMapDataDir = "..data"
+)
+
+// Config used by the collection loop and HTTP handlers, swapped on reload
+var currentConfig atomic.Pointer[configType]
+
+// Reload the config when the file changes or on SIGHUP and send valid new configs to the collection loop
+// The directory is watched because ConfigMap volumes replace files by swapping symlinks
+func watchConfig(configPath string, reloadCh chan<- *configType) {
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGHUP)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logMain.Error("cannot watch config, only SIGHUP reloads it", "err", err)
+	} else {
+		defer watcher.Close()
+
+		err = watcher.Add(filepath.Dir(configPath))
+		if err != nil {
+			logMain.Error("cannot watch config, only SIGHUP reloads it", "path", configPath, "err", err)
+		}
+	}
+
+	var debounceCh <-chan time.Time
+	lastVersion := currentConfig.Load().Version
+
+	for {
+		select {
+		case <-signalCh:
+			logMain.Info("SIGHUP received, reloading config", "path", configPath)
+		case event, ok := <-watcherEvents(watcher):
+			if !ok {
+				return
+			}
+			// Chmod events do not change the content, other files of the directory do not matter
+			if event.Op == fsnotify.Chmod || !configEventIsRelevant(configPath, event) {
+				continue
+			}
+			logMain.Debug("config changed", "file", event.Name, "op", event.Op)
+			debounceCh = time.After(configReloadDebounce)
+			continue
+		case <-debounceCh:
+			debounceCh = nil
+		case err := <-watcherErrors(watcher):
+			logMain.Error("config watcher failed", "err", err)
+			continue
+		}
+
+		newConfig, err := reloadConfig(configPath, lastVersion)
+		if err != nil {
+			logMain.Error("cannot reload config, keeping the current one", "path", configPath, "err", err)
+			metricConfigReloads.WithLabelValues("failure").Inc()
+			continue
+		}
+		if newConfig == nil {
+			continue
+		}
+
+		// The collection loop applies the config later, so the next event is compared with the sent one
+		lastVersion = newConfig.Version
+		reloadCh <- newConfig
+	}
+}
+
+// Check if the event is about the config file itself or the ConfigMap data symlink
+func configEventIsRelevant(configPath string, event fsnotify.Event) bool {
+	return filepath.Clean(event.Name) == filepath.Clean(configPath) || filepath.Base(event.Name) == configMapDataDir
+}
+
+// Read the changed config, nil if the content is the same as of the last version
+func reloadConfig(configPath, lastVersion string) (*configType, error) {
+	newConfig, err := readConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if newConfig.Version == lastVersion {
+		return nil, nil
+	}
+
+	// Informers are started once, Rollouts informer is absent if no namespace used Rollouts on start
+	if workloadKindUsed(newConfig, workloadKindRollout) && rolloutLister == nil {
+		return nil, fmt.Errorf("workload_kind %s is used for the first time, restart is required", workloadKindRollout)
+	}
+
+	return newConfig, nil
+}
+
+// Swap the config and register or unregister metrics of added and removed apps
+func applyConfig(oldConfig, newConfig *configType) {
+	if oldConfig.Exporter != newConfig.Exporter {
+		logMain.Warn("exporter listen address and metrics endpoint are changed on restart only")
+	}
+
+	updateAppMetrics(newConfig)
+	currentConfig.Store(newConfig)
+
+	// Forecast settings or queries may be changed
+	forecastModels = make(map[string]*forecastModelType)
+	metricConfigReloads.WithLabelValues("success").Inc()
+
+	logMain.Info("config reloaded", "version", newConfig.Version)
+}
+
+// Nil channels block forever, so a missing watcher leaves only SIGHUP
+func watcherEvents(watcher *fsnotify.Watcher) <-chan fsnotify.Event {
+	if watcher == nil {
+		return nil
+	}
+	return watcher.Events
+}
+
+func watcherErrors(watcher *fsnotify.Watcher) <-chan error {
+	if watcher == nil {
+		return nil
+	}
+	return watcher.Errors
+}
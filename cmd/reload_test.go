@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestConfigEventIsRelevant(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		want  bool
+	}{
+		{"config file", "/app/config.yaml", true},
+		{"config file with unclean path", "/app//config.yaml", true},
+		{"configmap data symlink", "/app/..data", true},
+		{"configmap timestamped directory", "/app/..2024_01_01_00_00_00.123", false},
+		{"editor swap file", "/app/.config.yaml.swp", false},
+		{"other file", "/app/other.yaml", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := configEventIsRelevant("/app/config.yaml", fsnotify.Event{Name: test.event, Op: fsnotify.Write})
+			if got != test.want {
+				t.Errorf("configEventIsRelevant() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(configData string) {
+		err := os.WriteFile(configPath, []byte(configData), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig(`
+prometheus:
+  address: http://prometheus:9090
+  query_template: 'sum(rate(requests{app="%s"}[1m]))'
+namespaces:
+  - name: shop
+    prometheus:
+      query_variable: shop
+`)
+
+	config, err := reloadConfig(configPath, "")
+	if err != nil || config == nil {
+		t.Fatalf("reloadConfig() = %v, %v, want the new config", config, err)
+	}
+
+	config, err = reloadConfig(configPath, config.Version)
+	if err != nil || config != nil {
+		t.Errorf("reloadConfig() of the same version = %v, %v, want nil", config, err)
+	}
+
+	writeConfig("prometheus: {}\n")
+
+	_, err = reloadConfig(configPath, "")
+	if err == nil {
+		t.Errorf("reloadConfig() of invalid config returned no error")
+	}
+}
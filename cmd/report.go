@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Formats of the report command output
+const (
+	reportOutputTable = "table"
+	reportOutputJSON  = "json"
+	reportOutputCSV   = "csv"
+)
+
+// Set from --output and --scenario flags
+var reportOutput, reportScenario string
+
+var scenarioReportColumns = []string{"APP", "RPS ADJUSTED", "RPS SCENARIO", "LOAD", "PODS", "PODS NEEDED", "ADDITIONAL CPU", "ADDITIONAL MEM", "PODS FIT", "LIMITED BY", "RUNS OUT", "ERROR"}
+
+var reportColumns = []string{"APP", "PODS", "RPS RAW", "RPS PEAK", "RPS ADJUSTED", "FULL CHAIN CPU", "FULL CHAIN MEM", "RPS COST CPU", "RPS COST MEM", "ADDITIONAL PODS", "LIMITED BY", "MAX TRAFFIC", "RPS HEADROOM", "ERROR"}
+
+// Run one collection cycle and print capacity of every app, return exit code
+func runReport(config *configType) int {
+	if reportScenario != "" {
+		return runScenarioReport(config)
+	}
+
+	snapshot := runCollectionCycle(config)
+
+	var err error
+	switch reportOutput {
+	case reportOutputTable:
+		err = printReportTable(snapshot)
+	case reportOutputJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(snapshot)
+	case reportOutputCSV:
+		err = printReportCSV(snapshot)
+	default:
+		err = checkReportOutput()
+	}
+
+	if err != nil {
+		logMain.Error("cannot print report", "err", err)
+		return 1
+	}
+
+	if len(snapshot.getAppErrors()) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Run one collection cycle and print what every app would need in the scenario, return exit code
+// Exit code is 2 if some app runs out of free resources
+func runScenarioReport(config *configType) int {
+	scenario := getScenario(config, reportScenario)
+	if scenario == nil {
+		logMain.Error("unknown scenario", "scenario", reportScenario)
+		return 1
+	}
+
+	result := calculateScenario(config, scenario, runCollectionCycle(config))
+
+	var err error
+	switch reportOutput {
+	case reportOutputTable:
+		err = printScenarioTable(result)
+	case reportOutputJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(result)
+	case reportOutputCSV:
+		err = printScenarioCSV(result)
+	default:
+		err = checkReportOutput()
+	}
+
+	if err != nil {
+		logMain.Error("cannot print report", "err", err)
+		return 1
+	}
+
+	for _, scenarioApp := range result.Apps {
+		if scenarioApp.Error != "" {
+			return 1
+		}
+	}
+	for _, scenarioApp := range result.Apps {
+		if scenarioApp.RunsOut {
+			return 2
+		}
+	}
+	return 0
+}
+
+// Output format is checked before connecting to the cluster
+func checkReportOutput() error {
+	if !inList(reportOutput, []string{reportOutputTable, reportOutputJSON, reportOutputCSV}) {
+		return fmt.Errorf("unknown output format %q, must be %s, %s or %s", reportOutput, reportOutputTable, reportOutputJSON, reportOutputCSV)
+	}
+	return nil
+}
+
+func printTableHeader(writer *tabwriter.Writer, columns []string) {
+	for columnNum, column := range columns {
+		if columnNum > 0 {
+			fmt.Fprint(writer, "\t")
+		}
+		fmt.Fprint(writer, column)
+	}
+	fmt.Fprintln(writer)
+}
+
+func printReportTable(snapshot *capacitySnapshotType) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	printTableHeader(writer, reportColumns)
+
+	for _, appCapacity := range snapshot.Apps {
+		if appCapacity.Error != "" {
+			fmt.Fprintf(writer, "%s\t-\t-\t-\t-\t-\t-\t-\t-\t-\t-\t-\t-\t%s\n", appCapacity.App, appCapacity.Error)
+			continue
+		}
+
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%.2fm\t%s\t%d\t%s\t%s\t%s\t\n",
+			appCapacity.App,
+			appCapacity.Pods,
+			appCapacity.RawRPS,
+			appCapacity.PeakRPS,
+			appCapacity.AdjustedRPS,
+			formatMilliCPU(appCapacity.FullChain[v1.ResourceCPU]),
+			formatBytes(appCapacity.FullChain[v1.ResourceMemory]),
+			appCapacity.OneRPSCost[v1.ResourceCPU],
+			formatBytes(int64(appCapacity.OneRPSCost[v1.ResourceMemory])),
+			appCapacity.ClusterCanHandleAdditionalPods,
+			appCapacity.LimitingResource,
+			formatTrafficMultiplier(appCapacity),
+			formatRPSHeadroom(appCapacity),
+		)
+	}
+
+	return writer.Flush()
+}
+
+// CSV keeps raw values: MilliCPUs and bytes
+func printReportCSV(snapshot *capacitySnapshotType) error {
+	writer := csv.NewWriter(os.Stdout)
+
+	err := writer.Write([]string{"app", "pods", "rps_raw", "rps_peak", "rps_adjusted", "full_chain_cpu", "full_chain_mem", "rps_cost_cpu", "rps_cost_mem", "additional_pods", "limited_by", "max_traffic_multiplier", "rps_headroom", "error"})
+	if err != nil {
+		return err
+	}
+
+	for _, appCapacity := range snapshot.Apps {
+		record := []string{appCapacity.App, "", "", "", "", "", "", "", "", "", "", "", "", appCapacity.Error}
+
+		if appCapacity.Error == "" {
+			record = []string{
+				appCapacity.App,
+				strconv.Itoa(appCapacity.Pods),
+				strconv.FormatInt(appCapacity.RawRPS, 10),
+				strconv.FormatInt(appCapacity.PeakRPS, 10),
+				strconv.FormatInt(appCapacity.AdjustedRPS, 10),
+				strconv.FormatInt(appCapacity.FullChain[v1.ResourceCPU], 10),
+				strconv.FormatInt(appCapacity.FullChain[v1.ResourceMemory], 10),
+				strconv.FormatFloat(appCapacity.OneRPSCost[v1.ResourceCPU], 'f', -1, 64),
+				strconv.FormatFloat(appCapacity.OneRPSCost[v1.ResourceMemory], 'f', -1, 64),
+				strconv.FormatInt(appCapacity.ClusterCanHandleAdditionalPods, 10),
+				string(appCapacity.LimitingResource),
+				strconv.FormatFloat(getTrafficMultiplier(appCapacity), 'f', 2, 64),
+				"",
+				"",
+			}
+		}
+
+		if appCapacity.RPSHeadroom != nil {
+			record[len(record)-2] = strconv.FormatInt(*appCapacity.RPSHeadroom, 10)
+		}
+
+		err = writer.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func printScenarioTable(result *scenarioResultType) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	printTableHeader(writer, scenarioReportColumns)
+
+	for _, scenarioApp := range result.Apps {
+		if scenarioApp.Error != "" {
+			fmt.Fprintf(writer, "%s\t-\t-\t-\t-\t-\t-\t-\t-\t-\t-\t%s\n", scenarioApp.App, scenarioApp.Error)
+			continue
+		}
+
+		runsOut := "-"
+		if scenarioApp.RunsOut {
+			runsOut = fmt.Sprintf("at %.0f%% of growth", *scenarioApp.RunsOutAt*100)
+		}
+
+		fmt.Fprintf(writer, "%s\t%d\t%d\tx%.2f\t%d\t%d\t%s\t%s\t%d\t%s\t%s\t\n",
+			scenarioApp.App,
+			scenarioApp.AdjustedRPS,
+			scenarioApp.ScenarioRPS,
+			scenarioApp.LoadIncrease,
+			scenarioApp.Pods,
+			scenarioApp.PodsNeeded,
+			formatMilliCPU(scenarioApp.AdditionalResources[v1.ResourceCPU]),
+			formatBytes(scenarioApp.AdditionalResources[v1.ResourceMemory]),
+			scenarioApp.PodsFit,
+			scenarioApp.LimitingResource,
+			runsOut,
+		)
+	}
+
+	return writer.Flush()
+}
+
+func printScenarioCSV(result *scenarioResultType) error {
+	writer := csv.NewWriter(os.Stdout)
+
+	err := writer.Write([]string{"app", "rps_adjusted", "rps_scenario", "load_increase", "pods", "pods_needed", "additional_cpu", "additional_mem", "pods_fit", "limited_by", "runs_out", "runs_out_at", "error"})
+	if err != nil {
+		return err
+	}
+
+	for _, scenarioApp := range result.Apps {
+		record := []string{scenarioApp.App, "", "", "", "", "", "", "", "", "", "", "", scenarioApp.Error}
+
+		if scenarioApp.Error == "" {
+			runsOutAt := ""
+			if scenarioApp.RunsOut {
+				runsOutAt = strconv.FormatFloat(*scenarioApp.RunsOutAt, 'f', 2, 64)
+			}
+
+			record = []string{
+				scenarioApp.App,
+				strconv.FormatInt(scenarioApp.AdjustedRPS, 10),
+				strconv.FormatInt(scenarioApp.ScenarioRPS, 10),
+				strconv.FormatFloat(scenarioApp.LoadIncrease, 'f', 2, 64),
+				strconv.Itoa(scenarioApp.Pods),
+				strconv.FormatInt(scenarioApp.PodsNeeded, 10),
+				strconv.FormatInt(scenarioApp.AdditionalResources[v1.ResourceCPU], 10),
+				strconv.FormatInt(scenarioApp.AdditionalResources[v1.ResourceMemory], 10),
+				strconv.FormatInt(scenarioApp.PodsFit, 10),
+				string(scenarioApp.LimitingResource),
+				strconv.FormatBool(scenarioApp.RunsOut),
+				runsOutAt,
+				"",
+			}
+		}
+
+		err = writer.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// How many times the current traffic can grow: every additional pod carries as much RPS as a current one
+func getTrafficMultiplier(appCapacity *appCapacityType) float64 {
+	if appCapacity.Pods == 0 {
+		return 0
+	}
+	return float64(int64(appCapacity.Pods)+appCapacity.ClusterCanHandleAdditionalPods) / float64(appCapacity.Pods)
+}
+
+func formatTrafficMultiplier(appCapacity *appCapacityType) string {
+	if appCapacity.Pods == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("x%.2f", getTrafficMultiplier(appCapacity))
+}
+
+func formatRPSHeadroom(appCapacity *appCapacityType) string {
+	if appCapacity.RPSHeadroom == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d (%s %s)", *appCapacity.RPSHeadroom, appCapacity.RPSHeadroomNamespace, appCapacity.RPSHeadroomResource)
+}
+
+func formatMilliCPU(milliCPU int64) string {
+	return resource.NewMilliQuantity(milliCPU, resource.DecimalSI).String()
+}
+
+func formatBytes(bytes int64) string {
+	return resource.NewQuantity(bytes, resource.BinarySI).String()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Resource amounts by resource name: MilliCPUs for cpu, plain values (bytes, devices) for everything else
+type resourcesType map[v1.ResourceName]int64
+
+// Resources taken into account when config has no resources list
+var defaultResources = []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory}
+
+// Get the list of resources the capacity is calculated for
+func getConfiguredResources(config *configType) []v1.ResourceName {
+	if len(config.Resources) == 0 {
+		return defaultResources
+	}
+	return config.Resources
+}
+
+// Convert Kubernetes resource list to configured resources
+func toResources(config *configType, list v1.ResourceList) resourcesType {
+	resources := make(resourcesType)
+
+	for _, name := range getConfiguredResources(config) {
+		resources[name] = getResourceValue(list, name)
+	}
+
+	return resources
+}
+
+func getResourceValue(list v1.ResourceList, name v1.ResourceName) int64 {
+	quantity, exists := list[name]
+	if !exists {
+		return 0
+	}
+
+	if name == v1.ResourceCPU {
+		return quantity.MilliValue()
+	}
+	return quantity.Value()
+}
+
+func addResources(resources, newResources resourcesType) {
+	for name, value := range newResources {
+		resources[name] += value
+	}
+}
+
+func multiplyResources(resources resourcesType, multiplier int64) resourcesType {
+	multipliedResources := make(resourcesType)
+
+	for name, value := range resources {
+		multipliedResources[name] = value * multiplier
+	}
+
+	return multipliedResources
+}
+
+func scaleResources(resources resourcesType, multiplier float64) resourcesType {
+	scaledResources := make(resourcesType)
+
+	for name, value := range resources {
+		scaledResources[name] = int64(math.Round(float64(value) * multiplier))
+	}
+
+	return scaledResources
+}
+
+func divideResources(resources resourcesType, divisor int64) resourcesType {
+	dividedResources := make(resourcesType)
+
+	for name, value := range resources {
+		dividedResources[name] = value / divisor
+	}
+
+	return dividedResources
+}
+
+func addResourceList(list, newList v1.ResourceList) {
+	for name, quantity := range newList {
+		value, exists := list[name]
+		if !exists {
+			list[name] = quantity.DeepCopy()
+			continue
+		}
+
+		value.Add(quantity)
+		list[name] = value
+	}
+}
+
+// Set every resource of the list to the biggest of both lists
+func maxResourceList(list, newList v1.ResourceList) {
+	for name, quantity := range newList {
+		value, exists := list[name]
+		if !exists || quantity.Cmp(value) > 0 {
+			list[name] = quantity.DeepCopy()
+		}
+	}
+}
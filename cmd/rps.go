@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Values of prometheus.rps_mode in config.yaml
+const (
+	rpsModeInstant = "instant"
+	rpsModeRange   = "range"
+)
+
+// Values of rps_aggregation in config.yaml, percentiles are written as pNN (p99, p95.5)
+const (
+	rpsAggregationMax = "max"
+	rpsAggregationAvg = "avg"
+)
+
+const (
+	rpsDefaultAggregation = rpsAggregationMax
+	rpsDefaultLookback    = "24h"
+	rpsDefaultStep        = "1m"
+
+	// Prometheus refuses range queries with more points
+	prometheusMaxRangePoints = 11000
+)
+
+// Get RPS of the namespace aggregated over the lookback window (from Prometheus range query)
+func getPeakRPS(config *configType, namespace string) (int64, error) {
+	lookback, step, err := getRPSRange(config)
+	if err != nil {
+		return 0, err
+	}
+
+	promQuery := parsePromQuery(config, namespace)
+	matrixResult, err := promRangeRequest(config, promQuery, lookback, step)
+	if err != nil {
+		return 0, err
+	}
+
+	// The first series is used, the same as for instant RPS
+	if len(matrixResult) == 0 || len(matrixResult[0].Values) == 0 {
+		return 0, nil
+	}
+
+	var values []float64
+	for _, samplePair := range matrixResult[0].Values {
+		values = append(values, float64(samplePair.Value))
+	}
+
+	aggregation := getRPSAggregation(config, namespace)
+	peakRPS, err := aggregateRPS(values, aggregation)
+	if err != nil {
+		return 0, err
+	}
+	logProm.Debug("peak RPS", "namespace", namespace, "aggregation", aggregation, "points", len(values), "rps", peakRPS)
+
+	return int64(math.Round(peakRPS)), nil
+}
+
+// Aggregate RPS values with max, avg or a percentile (pNN)
+func aggregateRPS(values []float64, aggregation string) (float64, error) {
+	var result float64
+
+	if len(values) == 0 {
+		return 0, nil
+	}
+
+	switch aggregation {
+	case rpsAggregationMax:
+		result = values[0]
+		for _, value := range values {
+			result = math.Max(result, value)
+		}
+
+	case rpsAggregationAvg:
+		for _, value := range values {
+			result += value
+		}
+		result /= float64(len(values))
+
+	default:
+		percentile, err := parseRPSPercentile(aggregation)
+		if err != nil {
+			return 0, err
+		}
+
+		sortedValues := append([]float64(nil), values...)
+		sort.Float64s(sortedValues)
+
+		// Nearest-rank percentile
+		rank := int(math.Ceil(percentile / 100 * float64(len(sortedValues))))
+		if rank < 1 {
+			rank = 1
+		}
+		result = sortedValues[rank-1]
+	}
+
+	return result, nil
+}
+
+func parseRPSPercentile(aggregation string) (float64, error) {
+	percentile, err := strconv.ParseFloat(strings.TrimPrefix(aggregation, "p"), 64)
+	if !strings.HasPrefix(aggregation, "p") || err != nil || percentile <= 0 || percentile > 100 {
+		return 0, fmt.Errorf("unknown RPS aggregation %q, must be %s, %s or a percentile like p99", aggregation, rpsAggregationMax, rpsAggregationAvg)
+	}
+	return percentile, nil
+}
+
+func getRPSMode(config *configType) string {
+	if config.Prometheus.RPSMode == "" {
+		return rpsModeInstant
+	}
+	return config.Prometheus.RPSMode
+}
+
+// Namespace's rps_aggregation overrides the global one
+func getRPSAggregation(config *configType, targetNamespace string) string {
+	for _, currentNamespace := range config.Namespaces {
+		if currentNamespace.Name == targetNamespace && currentNamespace.Prometheus.RPSAggregation != "" {
+			return currentNamespace.Prometheus.RPSAggregation
+		}
+	}
+
+	if config.Prometheus.RPSAggregation != "" {
+		return config.Prometheus.RPSAggregation
+	}
+	return rpsDefaultAggregation
+}
+
+func getRPSRange(config *configType) (time.Duration, time.Duration, error) {
+	lookback := config.Prometheus.RPSLookback
+	if lookback == "" {
+		lookback = rpsDefaultLookback
+	}
+
+	step := config.Prometheus.RPSStep
+	if step == "" {
+		step = rpsDefaultStep
+	}
+
+	lookbackDuration, err := model.ParseDuration(lookback)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid rps_lookback: %w", err)
+	}
+
+	stepDuration, err := model.ParseDuration(step)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid rps_step: %w", err)
+	}
+
+	return time.Duration(lookbackDuration), time.Duration(stepDuration), nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Traffic of frontends in a what-if scenario, other namespaces follow through dependencies
+type scenarioType struct {
+	Name      string
+	Frontends []struct {
+		Name          string
+		RPS           int64   `yaml:"rps"`
+		RPSMultiplier float64 `yaml:"rps_multiplier"`
+	}
+}
+
+type scenarioResultType struct {
+	Scenario           string             `json:"scenario"`
+	IngressMultipliers map[string]float64 `json:"ingress_multipliers"`
+	Apps               []*scenarioAppType `json:"apps"`
+}
+
+// What the app would need in the scenario compared to what the cluster has free for it
+type scenarioAppType struct {
+	App   string `json:"app"`
+	Error string `json:"error,omitempty"`
+
+	AdjustedRPS  int64   `json:"rps_adjusted"`
+	ScenarioRPS  int64   `json:"rps_scenario"`
+	LoadIncrease float64 `json:"load_increase"`
+
+	Pods           int   `json:"pods"`
+	PodsNeeded     int64 `json:"pods_needed"`
+	AdditionalPods int64 `json:"additional_pods"`
+
+	// Additional pods placed while all apps grow at the same time and share free resources of the nodes
+	PodsFit int64 `json:"pods_fit"`
+	// What prevented placing the next pod, empty if free resources are only fragmented between nodes
+	LimitingResource v1.ResourceName `json:"limiting_resource,omitempty"`
+
+	AdditionalResources resourcesType `json:"additional_resources"`
+	Free                resourcesType `json:"free"`
+	FullChain           resourcesType `json:"full_chain"`
+
+	// Share of the traffic growth after which the app runs out of free resources
+	RunsOut   bool     `json:"runs_out"`
+	RunsOutAt *float64 `json:"runs_out_at,omitempty"`
+}
+
+func getScenario(config *configType, name string) *scenarioType {
+	for scenarioNum := range config.Scenarios {
+		if config.Scenarios[scenarioNum].Name == name {
+			return &config.Scenarios[scenarioNum]
+		}
+	}
+	return nil
+}
+
+// Get RPS of the frontend in the scenario, the current RPS if the scenario does not change it
+func getScenarioRPS(scenario *scenarioType, app string, adjustedRPS int64) int64 {
+	for _, frontend := range scenario.Frontends {
+		if frontend.Name != app {
+			continue
+		}
+
+		if frontend.RPSMultiplier != 0 {
+			return int64(math.Round(float64(adjustedRPS) * frontend.RPSMultiplier))
+		}
+		return frontend.RPS
+	}
+	return adjustedRPS
+}
+
+// Calculate the scenario from the snapshot: frontends get new RPS, dependencies get the RPS of frontends which use them
+// Apps are returned in the order they run out of free resources, apps which do not run out are the last
+func calculateScenario(config *configType, scenario *scenarioType, snapshot *capacitySnapshotType) *scenarioResultType {
+	result := &scenarioResultType{Scenario: scenario.Name}
+	adjustedRPS := make(map[string]int64)
+	scenarioRPS := make(map[string]int64)
+	loadIncrease := make(map[string]float64)
+	scenarioOccupied := make(map[string]resourcesType)
+
+	for _, appCapacity := range snapshot.Apps {
+		adjustedRPS[appCapacity.App] = appCapacity.AdjustedRPS
+	}
+
+	for _, namespace := range config.Namespaces {
+		if namespace.Frontend {
+			scenarioRPS[namespace.Name] = getScenarioRPS(scenario, namespace.Name, adjustedRPS[namespace.Name])
+		}
+	}
+
+	result.IngressMultipliers = calculateIngressMultipliers(config, scenarioRPS)
+	logCalc.Debug("scenario ingress multipliers", "scenario", scenario.Name, "multipliers", result.IngressMultipliers)
+
+	// Load of a namespace grows as much as the total RPS of frontends which use it
+	for _, namespace := range config.Namespaces {
+		var currentRPS, newRPS int64
+
+		for _, frontend := range config.Namespaces {
+			if frontend.Frontend && (frontend.Name == namespace.Name || inList(namespace.Name, frontend.DependsOnFullChain)) {
+				currentRPS += adjustedRPS[frontend.Name]
+				newRPS += scenarioRPS[frontend.Name]
+			}
+		}
+
+		loadIncrease[namespace.Name] = 1
+		if currentRPS > 0 {
+			loadIncrease[namespace.Name] = float64(newRPS) / float64(currentRPS)
+		}
+		logCalc.Debug("scenario load increase", "scenario", scenario.Name, "namespace", namespace.Name, "increase", loadIncrease[namespace.Name])
+	}
+
+	for _, appCapacity := range snapshot.Apps {
+		scenarioOccupied[appCapacity.App] = scaleResources(appCapacity.ReallyOccupied, loadIncrease[appCapacity.App])
+	}
+
+	for _, appCapacity := range snapshot.Apps {
+		app := appCapacity.App
+		scenarioApp := &scenarioAppType{
+			App:          app,
+			Error:        appCapacity.Error,
+			AdjustedRPS:  appCapacity.AdjustedRPS,
+			LoadIncrease: loadIncrease[app],
+			Pods:         appCapacity.Pods,
+			Free:         appCapacity.Free,
+		}
+		result.Apps = append(result.Apps, scenarioApp)
+
+		if appCapacity.Error != "" {
+			continue
+		}
+
+		scenarioApp.ScenarioRPS = int64(math.Round(float64(appCapacity.AdjustedRPS) * loadIncrease[app]))
+		scenarioApp.FullChain = calculateFullChainResources(config, app, scenarioOccupied, result.IngressMultipliers)
+
+		scenarioApp.PodsNeeded = int64(math.Ceil(float64(appCapacity.Pods) * loadIncrease[app]))
+		if scenarioApp.PodsNeeded > int64(appCapacity.Pods) {
+			scenarioApp.AdditionalPods = scenarioApp.PodsNeeded - int64(appCapacity.Pods)
+		}
+
+		scenarioApp.AdditionalResources = make(resourcesType)
+		for name, value := range appCapacity.ReallyOccupied {
+			if scenarioOccupied[app][name] > value {
+				scenarioApp.AdditionalResources[name] = scenarioOccupied[app][name] - value
+			}
+		}
+
+	}
+
+	placeScenarioPods(snapshot, result.Apps)
+
+	for _, scenarioApp := range result.Apps {
+		logCalc.Debug("scenario", "scenario", scenario.Name, "namespace", scenarioApp.App, "podsNeeded", scenarioApp.PodsNeeded, "podsFit", scenarioApp.PodsFit, "runsOut", scenarioApp.RunsOut)
+	}
+
+	sort.SliceStable(result.Apps, func(i, j int) bool {
+		first, second := result.Apps[i], result.Apps[j]
+		if first.RunsOut != second.RunsOut {
+			return first.RunsOut
+		}
+		return first.RunsOut && *first.RunsOutAt < *second.RunsOutAt
+	})
+
+	return result
+}
+
+// Place additional pods of all apps on one copy of the nodes' free resources, subtracting every placed pod
+// The app which is the least far into its growth places the next pod, so apps grow together
+// and the app which fails first runs out at the smallest share of the growth
+func placeScenarioPods(snapshot *capacitySnapshotType, scenarioApps []*scenarioAppType) {
+	var pending []*scenarioAppType
+	sharedNodes := make(map[string]*nodeFreeResourcesType)
+	appNodes := make(map[string][]*nodeFreeResourcesType)
+	podResources := make(map[string]resourcesType)
+
+	for _, appCapacity := range snapshot.Apps {
+		if appCapacity.Error != "" || appCapacity.Pods == 0 {
+			continue
+		}
+
+		// Free resources of a node are the same for every app which may use it
+		for _, node := range appCapacity.Nodes {
+			sharedNode, exists := sharedNodes[node.Name]
+			if !exists {
+				sharedNode = &nodeFreeResourcesType{Name: node.Name, Resources: make(resourcesType), Pods: node.Pods}
+				addResources(sharedNode.Resources, node.Resources)
+				sharedNodes[node.Name] = sharedNode
+			}
+			appNodes[appCapacity.App] = append(appNodes[appCapacity.App], sharedNode)
+		}
+
+		podResources[appCapacity.App] = divideResources(appCapacity.ReallyOccupied, int64(appCapacity.Pods))
+	}
+
+	for _, scenarioApp := range scenarioApps {
+		if scenarioApp.Error == "" && scenarioApp.AdditionalPods > 0 {
+			pending = append(pending, scenarioApp)
+		}
+	}
+
+	for len(pending) > 0 {
+		nextNum := 0
+		for appNum, scenarioApp := range pending {
+			if getScenarioGrowth(scenarioApp) < getScenarioGrowth(pending[nextNum]) {
+				nextNum = appNum
+			}
+		}
+		scenarioApp := pending[nextNum]
+		pod := podResources[scenarioApp.App]
+
+		node := findNodeForPod(appNodes[scenarioApp.App], pod)
+		if node == nil {
+			runsOutAt := getScenarioGrowth(scenarioApp)
+			scenarioApp.RunsOut = true
+			scenarioApp.RunsOutAt = &runsOutAt
+			scenarioApp.LimitingResource = getPlacementLimit(appNodes[scenarioApp.App], pod)
+		} else {
+			for name, value := range pod {
+				node.Resources[name] -= value
+			}
+			node.Pods--
+			scenarioApp.PodsFit++
+		}
+
+		if scenarioApp.RunsOut || scenarioApp.PodsFit == scenarioApp.AdditionalPods {
+			pending = append(pending[:nextNum], pending[nextNum+1:]...)
+		}
+	}
+}
+
+// Share of the additional pods which are already placed
+func getScenarioGrowth(scenarioApp *scenarioAppType) float64 {
+	return float64(scenarioApp.PodsFit) / float64(scenarioApp.AdditionalPods)
+}
+
+// First node with enough free resources and a free pod slot
+func findNodeForPod(nodes []*nodeFreeResourcesType, pod resourcesType) *nodeFreeResourcesType {
+	for _, node := range nodes {
+		if node.Pods <= 0 {
+			continue
+		}
+
+		fits := true
+		for name, value := range pod {
+			if node.Resources[name] < value {
+				fits = false
+			}
+		}
+
+		if fits {
+			return node
+		}
+	}
+	return nil
+}
+
+// Find the resource (or pod slots) which no node has enough of for one more pod
+func getPlacementLimit(nodes []*nodeFreeResourcesType, pod resourcesType) v1.ResourceName {
+	var names []string
+	for name := range pod {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		resourceFits := false
+		for _, node := range nodes {
+			if node.Resources[v1.ResourceName(name)] >= pod[v1.ResourceName(name)] {
+				resourceFits = true
+			}
+		}
+
+		if !resourceFits {
+			return v1.ResourceName(name)
+		}
+	}
+
+	for _, node := range nodes {
+		if node.Pods > 0 {
+			return ""
+		}
+	}
+	return v1.ResourcePods
+}
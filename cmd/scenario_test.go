@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestPlaceScenarioPods(t *testing.T) {
+	nodes := []nodeFreeResourcesType{
+		{Name: "a", Resources: resourcesType{v1.ResourceCPU: 3000}, Pods: 100, Counted: true},
+		{Name: "b", Resources: resourcesType{v1.ResourceCPU: 3000}, Pods: 100, Counted: true},
+	}
+
+	// Every app alone fits its 8 additional pods of 500m into 6000m, both together do not
+	snapshot := &capacitySnapshotType{Apps: []*appCapacityType{
+		{App: "front", Pods: 2, ReallyOccupied: resourcesType{v1.ResourceCPU: 1000}, Nodes: nodes},
+		{App: "back", Pods: 1, ReallyOccupied: resourcesType{v1.ResourceCPU: 500}, Nodes: nodes},
+		{App: "idle", Pods: 1, ReallyOccupied: resourcesType{v1.ResourceCPU: 100}, Nodes: nodes},
+	}}
+	scenarioApps := []*scenarioAppType{
+		{App: "front", AdditionalPods: 8},
+		{App: "back", AdditionalPods: 8},
+		{App: "idle"},
+	}
+
+	placeScenarioPods(snapshot, scenarioApps)
+
+	front, back, idle := scenarioApps[0], scenarioApps[1], scenarioApps[2]
+	if front.PodsFit+back.PodsFit != 12 {
+		t.Errorf("placed %d + %d pods, want 12 in total", front.PodsFit, back.PodsFit)
+	}
+	if !front.RunsOut || !back.RunsOut {
+		t.Fatalf("runs out: front %v, back %v, want both", front.RunsOut, back.RunsOut)
+	}
+	if *front.RunsOutAt != 0.75 || front.LimitingResource != v1.ResourceCPU {
+		t.Errorf("front runs out at %v limited by %q, want 0.75 limited by cpu", *front.RunsOutAt, front.LimitingResource)
+	}
+	if idle.RunsOut || idle.PodsFit != 0 {
+		t.Errorf("idle app runs out %v with %d pods, want no pods and not running out", idle.RunsOut, idle.PodsFit)
+	}
+
+	// Snapshot is not changed
+	if nodes[0].Resources[v1.ResourceCPU] != 3000 {
+		t.Errorf("node free cpu changed to %d", nodes[0].Resources[v1.ResourceCPU])
+	}
+}
+
+func TestGetPlacementLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []*nodeFreeResourcesType
+		want  v1.ResourceName
+	}{
+		{
+			name:  "not enough cpu",
+			nodes: []*nodeFreeResourcesType{{Resources: resourcesType{v1.ResourceCPU: 100, v1.ResourceMemory: 1000}, Pods: 1}},
+			want:  v1.ResourceCPU,
+		},
+		{
+			name:  "no pod slots",
+			nodes: []*nodeFreeResourcesType{{Resources: resourcesType{v1.ResourceCPU: 1000, v1.ResourceMemory: 1000}, Pods: 0}},
+			want:  v1.ResourcePods,
+		},
+		{
+			name: "fragmented",
+			nodes: []*nodeFreeResourcesType{
+				{Resources: resourcesType{v1.ResourceCPU: 1000, v1.ResourceMemory: 100}, Pods: 1},
+				{Resources: resourcesType{v1.ResourceCPU: 100, v1.ResourceMemory: 1000}, Pods: 1},
+			},
+			want: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := getPlacementLimit(test.nodes, resourcesType{v1.ResourceCPU: 500, v1.ResourceMemory: 500})
+			if got != test.want {
+				t.Errorf("getPlacementLimit() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	nodev1 "k8s.io/api/node/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	appsListersV1 "k8s.io/client-go/listers/apps/v1"
+	listersV1 "k8s.io/client-go/listers/core/v1"
+	nodeListersV1 "k8s.io/client-go/listers/node/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/metrics/pkg/apis/metrics/v1beta1"
+)
+
+const (
+	defaultSnapshotPath = "capacity-snapshot.json"
+
+	// Written instead of secrets of the recorded config
+	redactedValue = "<redacted>"
+)
+
+// Everything one collection cycle reads from Kubernetes, metrics API and Prometheus
+type clusterSnapshotType struct {
+	Time   time.Time `json:"time"`
+	Config string    `json:"config"`
+
+	Nodes          []v1.Node                `json:"nodes"`
+	Pods           []v1.Pod                 `json:"pods"`
+	PodMetrics     []v1beta1.PodMetrics     `json:"pod_metrics"`
+	Deployments    []appsv1.Deployment      `json:"deployments"`
+	ReplicaSets    []appsv1.ReplicaSet      `json:"replica_sets"`
+	StatefulSets   []appsv1.StatefulSet     `json:"stateful_sets"`
+	DaemonSets     []appsv1.DaemonSet       `json:"daemon_sets"`
+	Rollouts       []map[string]interface{} `json:"rollouts,omitempty"`
+	RuntimeClasses []nodev1.RuntimeClass    `json:"runtime_classes"`
+
+	// Results of Prometheus queries by query, range queries by query with the lookback and step
+	PrometheusResults      map[string]model.Vector `json:"prometheus_results"`
+	PrometheusRangeResults map[string]model.Matrix `json:"prometheus_range_results,omitempty"`
+
+	// Kubernetes objects already recorded by kind, namespace and name
+	recordedKeys map[string]bool
+}
+
+// Set from --snapshot-file and --from-snapshot flags
+var snapshotPath, fromSnapshotPath string
+
+var (
+	// Filled with everything read from the cluster and Prometheus while the snapshot command runs a cycle
+	recordedSnapshot *clusterSnapshotType
+
+	// Read instead of the cluster and Prometheus in --from-snapshot mode
+	replayedSnapshot *clusterSnapshotType
+)
+
+// Run one collection cycle and write everything it has read to the snapshot file, return exit code
+func runSnapshot(config *configType, configPath string) int {
+	var configData []byte
+	var err error
+
+	if configFromSnapshot() {
+		configData = []byte(replayedSnapshot.Config)
+	} else {
+		configData, err = ioutil.ReadFile(configPath)
+		if err != nil {
+			logMain.Error("cannot read config", "path", configPath, "err", err)
+			return 1
+		}
+	}
+
+	configData, err = redactConfig(configData)
+	if err != nil {
+		logMain.Error("cannot redact config", "path", configPath, "err", err)
+		return 1
+	}
+
+	recordedSnapshot = &clusterSnapshotType{
+		Time:                   time.Now(),
+		Config:                 string(configData),
+		PrometheusResults:      make(map[string]model.Vector),
+		PrometheusRangeResults: make(map[string]model.Matrix),
+	}
+
+	capacitySnapshot := runCollectionCycle(config)
+
+	snapshotData, err := json.Marshal(recordedSnapshot)
+	if err != nil {
+		logMain.Error("cannot encode snapshot", "err", err)
+		return 1
+	}
+
+	err = ioutil.WriteFile(snapshotPath, snapshotData, 0644)
+	if err != nil {
+		logMain.Error("cannot write snapshot", "path", snapshotPath, "err", err)
+		return 1
+	}
+
+	logMain.Info("snapshot is written", "path", snapshotPath, "nodes", len(recordedSnapshot.Nodes), "pods", len(recordedSnapshot.Pods), "queries", len(recordedSnapshot.PrometheusResults))
+
+	// Snapshot of a failed cycle is still useful for debugging
+	for app, appErr := range capacitySnapshot.getAppErrors() {
+		logMain.Warn("app failed in the recorded cycle", "namespace", app, "err", appErr)
+	}
+
+	return 0
+}
+
+// Snapshots are shared for debugging, so the Prometheus password and header values are not written
+func redactConfig(configData []byte) ([]byte, error) {
+	var root yaml.Node
+
+	err := yaml.Unmarshal(configData, &root)
+	if err != nil {
+		return nil, err
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return configData, nil
+	}
+
+	prometheus := getYAMLMappingValue(root.Content[0], "prometheus")
+
+	password := getYAMLMappingValue(getYAMLMappingValue(getYAMLMappingValue(prometheus, "auth"), "basic"), "password")
+	if password != nil {
+		password.SetString(redactedValue)
+	}
+
+	headers := getYAMLMappingValue(prometheus, "headers")
+	if headers != nil && headers.Kind == yaml.MappingNode {
+		for contentNum := 1; contentNum < len(headers.Content); contentNum += 2 {
+			headers.Content[contentNum].SetString(redactedValue)
+		}
+	}
+
+	return yaml.Marshal(&root)
+}
+
+// Value of the key in the mapping node, nil if either is absent
+func getYAMLMappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for contentNum := 0; contentNum+1 < len(node.Content); contentNum += 2 {
+		if node.Content[contentNum].Value == key {
+			return node.Content[contentNum+1]
+		}
+	}
+
+	return nil
+}
+
+// Objects are recorded with the fields the calculation reads only,
+// env, args, annotations and the rest of specs may contain secrets
+func sanitizeObjectMeta(objectMeta metav1.ObjectMeta) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:            objectMeta.Name,
+		Namespace:       objectMeta.Namespace,
+		UID:             objectMeta.UID,
+		Labels:          objectMeta.Labels,
+		OwnerReferences: objectMeta.OwnerReferences,
+	}
+}
+
+func sanitizeContainers(containers []v1.Container) []v1.Container {
+	var sanitized []v1.Container
+
+	for _, container := range containers {
+		sanitized = append(sanitized, v1.Container{
+			Name:          container.Name,
+			Resources:     container.Resources,
+			RestartPolicy: container.RestartPolicy,
+		})
+	}
+
+	return sanitized
+}
+
+func sanitizePodSpec(podSpec v1.PodSpec) v1.PodSpec {
+	return v1.PodSpec{
+		NodeName:         podSpec.NodeName,
+		InitContainers:   sanitizeContainers(podSpec.InitContainers),
+		Containers:       sanitizeContainers(podSpec.Containers),
+		Tolerations:      podSpec.Tolerations,
+		Affinity:         podSpec.Affinity,
+		NodeSelector:     podSpec.NodeSelector,
+		RuntimeClassName: podSpec.RuntimeClassName,
+		Overhead:         podSpec.Overhead,
+	}
+}
+
+func sanitizePodTemplate(template v1.PodTemplateSpec) v1.PodTemplateSpec {
+	return v1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: template.Labels},
+		Spec:       sanitizePodSpec(template.Spec),
+	}
+}
+
+// Every object is recorded once, the first read of a cycle wins
+func recordOnce(kind string, objectMeta metav1.Object) bool {
+	key := kind + "/" + objectMeta.GetNamespace() + "/" + objectMeta.GetName()
+
+	if recordedSnapshot.recordedKeys == nil {
+		recordedSnapshot.recordedKeys = make(map[string]bool)
+	}
+	if recordedSnapshot.recordedKeys[key] {
+		return false
+	}
+	recordedSnapshot.recordedKeys[key] = true
+
+	return true
+}
+
+func recordNodes(nodes []v1.Node) {
+	if recordedSnapshot == nil {
+		return
+	}
+
+	for _, node := range nodes {
+		if !recordOnce("node", &node) {
+			continue
+		}
+		recordedSnapshot.Nodes = append(recordedSnapshot.Nodes, v1.Node{
+			ObjectMeta: sanitizeObjectMeta(node.ObjectMeta),
+			Spec:       v1.NodeSpec{Unschedulable: node.Spec.Unschedulable, Taints: node.Spec.Taints},
+			Status: v1.NodeStatus{
+				Capacity:    node.Status.Capacity,
+				Allocatable: node.Status.Allocatable,
+				Conditions:  node.Status.Conditions,
+			},
+		})
+	}
+}
+
+func recordPods(pods []v1.Pod) {
+	if recordedSnapshot == nil {
+		return
+	}
+
+	for _, pod := range pods {
+		if !recordOnce("pod", &pod) {
+			continue
+		}
+		recordedSnapshot.Pods = append(recordedSnapshot.Pods, v1.Pod{
+			ObjectMeta: sanitizeObjectMeta(pod.ObjectMeta),
+			Spec:       sanitizePodSpec(pod.Spec),
+			Status:     v1.PodStatus{Phase: pod.Status.Phase},
+		})
+	}
+}
+
+func recordDeployment(deployment *appsv1.Deployment) {
+	if recordedSnapshot == nil || !recordOnce("deployment", deployment) {
+		return
+	}
+
+	recordedSnapshot.Deployments = append(recordedSnapshot.Deployments, appsv1.Deployment{
+		ObjectMeta: sanitizeObjectMeta(deployment.ObjectMeta),
+		Spec: appsv1.DeploymentSpec{
+			Replicas: deployment.Spec.Replicas,
+			Selector: deployment.Spec.Selector,
+			Template: sanitizePodTemplate(deployment.Spec.Template),
+		},
+	})
+}
+
+func recordReplicaSets(replicaSets []*appsv1.ReplicaSet) {
+	if recordedSnapshot == nil {
+		return
+	}
+
+	for _, replicaSet := range replicaSets {
+		if !recordOnce("replicaset", replicaSet) {
+			continue
+		}
+		recordedSnapshot.ReplicaSets = append(recordedSnapshot.ReplicaSets, appsv1.ReplicaSet{
+			ObjectMeta: sanitizeObjectMeta(replicaSet.ObjectMeta),
+			Spec:       appsv1.ReplicaSetSpec{Replicas: replicaSet.Spec.Replicas, Selector: replicaSet.Spec.Selector},
+		})
+	}
+}
+
+func recordStatefulSet(statefulSet *appsv1.StatefulSet) {
+	if recordedSnapshot == nil || !recordOnce("statefulset", statefulSet) {
+		return
+	}
+
+	recordedSnapshot.StatefulSets = append(recordedSnapshot.StatefulSets, appsv1.StatefulSet{
+		ObjectMeta: sanitizeObjectMeta(statefulSet.ObjectMeta),
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: statefulSet.Spec.Replicas,
+			Selector: statefulSet.Spec.Selector,
+			Template: sanitizePodTemplate(statefulSet.Spec.Template),
+		},
+	})
+}
+
+func recordDaemonSet(daemonSet *appsv1.DaemonSet) {
+	if recordedSnapshot == nil || !recordOnce("daemonset", daemonSet) {
+		return
+	}
+
+	recordedSnapshot.DaemonSets = append(recordedSnapshot.DaemonSets, appsv1.DaemonSet{
+		ObjectMeta: sanitizeObjectMeta(daemonSet.ObjectMeta),
+		Spec: appsv1.DaemonSetSpec{
+			Selector: daemonSet.Spec.Selector,
+			Template: sanitizePodTemplate(daemonSet.Spec.Template),
+		},
+		Status: appsv1.DaemonSetStatus{DesiredNumberScheduled: daemonSet.Status.DesiredNumberScheduled},
+	})
+}
+
+// Rollouts are kept unstructured, the template is sanitized as the one of a Deployment
+func recordRollout(rollout *unstructured.Unstructured, template *v1.PodTemplateSpec) error {
+	if recordedSnapshot == nil || !recordOnce("rollout", rollout) {
+		return nil
+	}
+
+	sanitized := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	sanitized.SetAPIVersion(rollout.GetAPIVersion())
+	sanitized.SetKind(rollout.GetKind())
+	sanitized.SetNamespace(rollout.GetNamespace())
+	sanitized.SetName(rollout.GetName())
+	sanitized.SetUID(rollout.GetUID())
+	sanitized.SetLabels(rollout.GetLabels())
+
+	for _, field := range []string{"replicas", "selector", "workloadRef"} {
+		value, found, err := unstructured.NestedFieldCopy(rollout.Object, "spec", field)
+		if err != nil {
+			return err
+		}
+		if found {
+			err = unstructured.SetNestedField(sanitized.Object, value, "spec", field)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if template != nil {
+		sanitizedTemplate := sanitizePodTemplate(*template)
+		templateData, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&sanitizedTemplate)
+		if err != nil {
+			return err
+		}
+		err = unstructured.SetNestedField(sanitized.Object, templateData, "spec", "template")
+		if err != nil {
+			return err
+		}
+	}
+
+	recordedSnapshot.Rollouts = append(recordedSnapshot.Rollouts, sanitized.Object)
+	return nil
+}
+
+func recordRuntimeClass(runtimeClass *nodev1.RuntimeClass) {
+	if recordedSnapshot == nil || !recordOnce("runtimeclass", runtimeClass) {
+		return
+	}
+
+	recordedSnapshot.RuntimeClasses = append(recordedSnapshot.RuntimeClasses, nodev1.RuntimeClass{
+		ObjectMeta: metav1.ObjectMeta{Name: runtimeClass.Name},
+		Handler:    runtimeClass.Handler,
+		Overhead:   runtimeClass.Overhead,
+	})
+}
+
+func readSnapshot(path string) (*clusterSnapshotType, error) {
+	snapshotData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &clusterSnapshotType{}
+	err = json.Unmarshal(snapshotData, snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse snapshot %s: %w", path, err)
+	}
+
+	return snapshot, nil
+}
+
+// Fill listers from the snapshot instead of starting informers
+func startSnapshotListers(snapshot *clusterSnapshotType) error {
+	newIndexer := func() cache.Indexer {
+		return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	}
+
+	nodeIndexer := newIndexer()
+	for nodeNum := range snapshot.Nodes {
+		err := nodeIndexer.Add(&snapshot.Nodes[nodeNum])
+		if err != nil {
+			return err
+		}
+	}
+	nodeLister = listersV1.NewNodeLister(nodeIndexer)
+
+	podIndexer := newIndexer()
+	for podNum := range snapshot.Pods {
+		err := podIndexer.Add(&snapshot.Pods[podNum])
+		if err != nil {
+			return err
+		}
+	}
+	podLister = listersV1.NewPodLister(podIndexer)
+
+	deploymentIndexer := newIndexer()
+	for deploymentNum := range snapshot.Deployments {
+		err := deploymentIndexer.Add(&snapshot.Deployments[deploymentNum])
+		if err != nil {
+			return err
+		}
+	}
+	deploymentLister = appsListersV1.NewDeploymentLister(deploymentIndexer)
+
+	replicaSetIndexer := newIndexer()
+	for replicaSetNum := range snapshot.ReplicaSets {
+		err := replicaSetIndexer.Add(&snapshot.ReplicaSets[replicaSetNum])
+		if err != nil {
+			return err
+		}
+	}
+	replicaSetLister = appsListersV1.NewReplicaSetLister(replicaSetIndexer)
+
+	statefulSetIndexer := newIndexer()
+	for statefulSetNum := range snapshot.StatefulSets {
+		err := statefulSetIndexer.Add(&snapshot.StatefulSets[statefulSetNum])
+		if err != nil {
+			return err
+		}
+	}
+	statefulSetLister = appsListersV1.NewStatefulSetLister(statefulSetIndexer)
+
+	daemonSetIndexer := newIndexer()
+	for daemonSetNum := range snapshot.DaemonSets {
+		err := daemonSetIndexer.Add(&snapshot.DaemonSets[daemonSetNum])
+		if err != nil {
+			return err
+		}
+	}
+	daemonSetLister = appsListersV1.NewDaemonSetLister(daemonSetIndexer)
+
+	runtimeClassIndexer := newIndexer()
+	for runtimeClassNum := range snapshot.RuntimeClasses {
+		err := runtimeClassIndexer.Add(&snapshot.RuntimeClasses[runtimeClassNum])
+		if err != nil {
+			return err
+		}
+	}
+	runtimeClassLister = nodeListersV1.NewRuntimeClassLister(runtimeClassIndexer)
+
+	rolloutIndexer := newIndexer()
+	for _, rolloutObject := range snapshot.Rollouts {
+		err := rolloutIndexer.Add(&unstructured.Unstructured{Object: rolloutObject})
+		if err != nil {
+			return err
+		}
+	}
+	rolloutLister = cache.NewGenericLister(rolloutIndexer, rolloutResource.GroupResource())
+
+	logK8s.Info("listers are filled from the snapshot", "time", snapshot.Time, "nodes", len(snapshot.Nodes), "pods", len(snapshot.Pods))
+	return nil
+}
+
+// Pod metrics of the replayed snapshot, all or of one namespace
+func getSnapshotPodMetricsList(namespace string) v1beta1.PodMetricsList {
+	var podMetricsList v1beta1.PodMetricsList
+
+	for _, podMetrics := range replayedSnapshot.PodMetrics {
+		if namespace == "" || podMetrics.Namespace == namespace {
+			podMetricsList.Items = append(podMetricsList.Items, podMetrics)
+		}
+	}
+
+	return podMetricsList
+}
+
+func getSnapshotPromResult(query string) (model.Vector, error) {
+	vectorResult, exists := replayedSnapshot.PrometheusResults[query]
+	if !exists {
+		return nil, fmt.Errorf("Prometheus query %q is not recorded in the snapshot", query)
+	}
+
+	logProm.Debug("response from the snapshot", "query", query)
+	return vectorResult, nil
+}
+
+func getSnapshotPromRangeResult(query string, lookback, step time.Duration) (model.Matrix, error) {
+	rangeQueryKey := getRangeQueryKey(query, lookback, step)
+
+	matrixResult, exists := replayedSnapshot.PrometheusRangeResults[rangeQueryKey]
+	if !exists {
+		return nil, fmt.Errorf("Prometheus range query %q is not recorded in the snapshot", rangeQueryKey)
+	}
+
+	logProm.Debug("range response from the snapshot", "query", query)
+	return matrixResult, nil
+}
+
+// The same query is used with different ranges (peak RPS and forecast)
+func getRangeQueryKey(query string, lookback, step time.Duration) string {
+	return fmt.Sprintf("%s [%s:%s]", query, model.Duration(lookback), model.Duration(step))
+}
+
+// Config stored in the snapshot is used unless --config is set explicitly
+func configFromSnapshot() bool {
+	return replayedSnapshot != nil && replayedSnapshot.Config != "" && !pflag.CommandLine.Changed("config")
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func newSecretPodSpec() v1.PodSpec {
+	container := newContainer("app", "200m")
+	container.Args = []string{"--token=args-secret"}
+	container.Env = []v1.EnvVar{{Name: "DB_PASSWORD", Value: "env-secret"}}
+
+	return v1.PodSpec{
+		NodeName:     "node-1",
+		Containers:   []v1.Container{container},
+		NodeSelector: map[string]string{"zone": "1a"},
+		Overhead:     v1.ResourceList{v1.ResourceCPU: resource.MustParse("50m")},
+	}
+}
+
+func newSecretObjectMeta(name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Namespace:   "shop",
+		Name:        name,
+		Labels:      map[string]string{"app": "shop"},
+		Annotations: map[string]string{"kubectl.kubernetes.io/last-applied-configuration": "annotation-secret"},
+	}
+}
+
+func TestRecordedObjectsAreSanitized(t *testing.T) {
+	recordedSnapshot = &clusterSnapshotType{}
+	defer func() { recordedSnapshot = nil }()
+
+	pod := v1.Pod{
+		ObjectMeta: newSecretObjectMeta("shop-1"),
+		Spec:       newSecretPodSpec(),
+		Status:     v1.PodStatus{Phase: v1.PodRunning, Message: "status-secret"},
+	}
+	recordPods([]v1.Pod{pod, pod})
+
+	template := v1.PodTemplateSpec{ObjectMeta: newSecretObjectMeta(""), Spec: newSecretPodSpec()}
+	recordDeployment(&appsv1.Deployment{
+		ObjectMeta: newSecretObjectMeta("shop"),
+		Spec:       appsv1.DeploymentSpec{Template: template},
+	})
+
+	templateData, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rollout := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"namespace": "shop", "name": "shop-rollout", "annotations": map[string]interface{}{"note": "annotation-secret"}},
+		"spec":     map[string]interface{}{"replicas": int64(3), "template": templateData, "strategy": map[string]interface{}{"canary": "strategy-secret"}},
+	}}
+	err = recordRollout(rollout, &template)
+	if err != nil {
+		t.Fatalf("recordRollout() error = %v", err)
+	}
+
+	if len(recordedSnapshot.Pods) != 1 {
+		t.Fatalf("recorded %d pods, want the pod recorded once", len(recordedSnapshot.Pods))
+	}
+	recordedPod := recordedSnapshot.Pods[0]
+	if recordedPod.Spec.NodeName != "node-1" || recordedPod.Status.Phase != v1.PodRunning || recordedPod.Labels["app"] != "shop" {
+		t.Errorf("recorded pod lost node name, phase or labels: %+v", recordedPod)
+	}
+	if got := getPodRequests(&recordedPod.Spec); got.Cpu().MilliValue() != 250 {
+		t.Errorf("recorded pod requests cpu = %dm, want 250m", got.Cpu().MilliValue())
+	}
+	if recordedSnapshot.Deployments[0].Spec.Template.Spec.NodeSelector["zone"] != "1a" {
+		t.Errorf("recorded deployment lost node selector")
+	}
+	if replicas, _, _ := unstructured.NestedInt64(recordedSnapshot.Rollouts[0], "spec", "replicas"); replicas != 3 {
+		t.Errorf("recorded rollout replicas = %d, want 3", replicas)
+	}
+
+	snapshotData, err := json.Marshal(recordedSnapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"args-secret", "env-secret", "annotation-secret", "status-secret", "strategy-secret"} {
+		if strings.Contains(string(snapshotData), secret) {
+			t.Errorf("snapshot contains %q", secret)
+		}
+	}
+}
+
+func TestSnapshotConfigIsRedacted(t *testing.T) {
+	configData := `
+prometheus:
+  address: http://prometheus:9090
+  query_template: sum(rate(requests_total{ingress="%s"}[1m]))
+  auth:
+    basic:
+      username: exporter
+      password: basic-secret
+  headers:
+    X-Scope-OrgID: header-secret
+namespaces: []
+`
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(configPath, []byte(configData), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := readConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty cluster without namespaces, only the config is recorded
+	replayedSnapshot = &clusterSnapshotType{}
+	defer func() { replayedSnapshot, recordedSnapshot = nil, nil }()
+	err = startSnapshotListers(replayedSnapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(previousPath string) { snapshotPath = previousPath }(snapshotPath)
+	snapshotPath = filepath.Join(t.TempDir(), "snapshot.json")
+	if exitCode := runSnapshot(config, configPath); exitCode != 0 {
+		t.Fatalf("runSnapshot() = %d, want 0", exitCode)
+	}
+
+	snapshot, err := readSnapshot(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"basic-secret", "header-secret"} {
+		if strings.Contains(snapshot.Config, secret) {
+			t.Errorf("snapshot config contains %q:\n%s", secret, snapshot.Config)
+		}
+	}
+
+	// The rest of the config is kept for replaying
+	recordedConfig, err := parseConfig([]byte(snapshot.Config), "snapshot")
+	if err != nil {
+		t.Fatalf("recorded config is not valid: %v", err)
+	}
+	if recordedConfig.Prometheus.Auth.Basic.Username != "exporter" || recordedConfig.Prometheus.Headers["X-Scope-OrgID"] != redactedValue || recordedConfig.Prometheus.Address != config.Prometheus.Address {
+		t.Errorf("recorded config lost fields:\n%s", snapshot.Config)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const readinessCheckTimeout = 5
+
+// State of the collection loop shown by /readyz and /status
+type exporterStatusType struct {
+	mutex             sync.RWMutex
+	started           bool
+	firstCycleDone    bool
+	lastCycleTime     time.Time
+	lastCycleDuration time.Duration
+	appErrors         map[string]string
+	configVersion     string
+}
+
+type statusResponseType struct {
+	Ready                    bool              `json:"ready"`
+	LastCycleTime            *time.Time        `json:"last_cycle_time"`
+	LastCycleDurationSeconds float64           `json:"last_cycle_duration_seconds"`
+	AppErrors                map[string]string `json:"app_errors"`
+	ConfigVersion            string            `json:"config_version"`
+}
+
+var exporterStatus exporterStatusType
+
+// Remember the result of the finished collection cycle
+// Cycle is full when the cluster state was collected and capacity was calculated
+func (status *exporterStatusType) finishCycle(config *configType, snapshot *capacitySnapshotType) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	if snapshot.Complete {
+		status.firstCycleDone = true
+	}
+	status.lastCycleTime = snapshot.Time
+	status.lastCycleDuration = time.Since(snapshot.Time)
+	status.configVersion = config.Version
+	status.appErrors = snapshot.getAppErrors()
+}
+
+// Informer caches are synced, collection cycles can run
+func (status *exporterStatusType) markStarted() {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	status.started = true
+}
+
+func (status *exporterStatusType) isStarted() bool {
+	status.mutex.RLock()
+	defer status.mutex.RUnlock()
+
+	return status.started
+}
+
+func (status *exporterStatusType) getResponse() statusResponseType {
+	status.mutex.RLock()
+	defer status.mutex.RUnlock()
+
+	response := statusResponseType{
+		Ready:                    status.firstCycleDone,
+		LastCycleDurationSeconds: status.lastCycleDuration.Seconds(),
+		AppErrors:                status.appErrors,
+		ConfigVersion:            status.configVersion,
+	}
+
+	if status.firstCycleDone {
+		lastCycleTime := status.lastCycleTime
+		response.LastCycleTime = &lastCycleTime
+	}
+
+	return response
+}
+
+// Process is alive as long as it answers after informer caches are synced
+// Until then it is starting, startup probe covers the sync (bounded by --cache-sync-timeout)
+func healthzHandler(writer http.ResponseWriter, request *http.Request) {
+	if !exporterStatus.isStarted() {
+		http.Error(writer, "informer caches are not synced yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(writer, "ok")
+}
+
+// Ready when the first full cycle is done and both Kubernetes and Prometheus are reachable
+func readyzHandler(writer http.ResponseWriter, request *http.Request) {
+	var problems []string
+	config := currentConfig.Load()
+
+	if !exporterStatus.getResponse().Ready {
+		problems = append(problems, "first collection cycle is not finished yet")
+	}
+
+	// Snapshot replay does not use the backends
+	if replayedSnapshot == nil {
+		err := checkKubernetesReachable()
+		if err != nil {
+			problems = append(problems, "kubernetes: "+err.Error())
+		}
+
+		_, err = promRequest(config, "vector(1)", promQueryParamsType{PromTimeout: readinessCheckTimeout})
+		if err != nil {
+			problems = append(problems, "prometheus: "+err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		http.Error(writer, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(writer, "ok")
+}
+
+func statusHandler(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, exporterStatus.getResponse())
+}
+
+func checkKubernetesReachable() error {
+	clientset, err := getMetaV1Clientset()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), readinessCheckTimeout*time.Second)
+	defer cancel()
+
+	return clientset.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error()
+}
+
+// Response is encoded before the status is sent, so encoding errors are reported as 500
+func writeJSON(writer http.ResponseWriter, statusCode int, data interface{}) {
+	var body bytes.Buffer
+
+	encoder := json.NewEncoder(&body)
+	encoder.SetIndent("", "  ")
+
+	err := encoder.Encode(data)
+	if err != nil {
+		logMain.Error("cannot encode JSON response", "err", err)
+		http.Error(writer, "cannot encode JSON response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	writer.Write(body.Bytes())
+}
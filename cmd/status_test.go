@@ -0,0 +1,24 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteJSON(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeJSON(recorder, http.StatusOK, map[string]float64{"value": 1})
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "{\n  \"value\": 1\n}\n" {
+		t.Errorf("writeJSON() = %d %q, want 200 with the value", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	writeJSON(recorder, http.StatusOK, map[string]float64{"value": math.NaN()})
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("writeJSON() with NaN = %d, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/metrics/pkg/apis/metrics/v1beta1"
+)
+
+// Values of usage.source in config.yaml
+const (
+	usageSourceMetricsServer = "metrics-server"
+	usageSourcePrometheus    = "prometheus"
+)
+
+const (
+	usageDefaultWindow     = "1h"
+	usageDefaultResolution = "1m"
+	usageDefaultPercentile = 95
+	usageCPURateWindow     = "5m"
+)
+
+// Default queries must return container usage labeled with namespace, pod and container
+// Arguments: quantile, window, resolution (and rate window for cpu)
+const (
+	usageDefaultCPUQuery    = `quantile_over_time(%[1]v, sum by (namespace, pod, container) (rate(container_cpu_usage_seconds_total{container!="", container!="POD"}[%[4]s]))[%[2]s:%[3]s])`
+	usageDefaultMemoryQuery = `quantile_over_time(%[1]v, sum by (namespace, pod, container) (container_memory_working_set_bytes{container!="", container!="POD"})[%[2]s:%[3]s])`
+)
+
+// Get container usage from metrics-server or, if configured, as a percentile over a window from Prometheus
+func getUsageMetricsList(config *configType) (v1beta1.PodMetricsList, string, error) {
+	if config.Usage.Source == usageSourcePrometheus {
+		podMetricsList, err := getPrometheusPodMetricsList(config)
+		return podMetricsList, "prometheus", err
+	}
+
+	podMetricsList, err := getPodMetricsList()
+	return podMetricsList, "metrics", err
+}
+
+// Build pod metrics from Prometheus, so used resources are stable and do not follow every spike
+func getPrometheusPodMetricsList(config *configType) (v1beta1.PodMetricsList, error) {
+	var podMetricsList v1beta1.PodMetricsList
+	podMetricsIndex := make(map[string]int)
+	containerIndex := make(map[string]int)
+
+	for _, resourceName := range []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory} {
+		query := getUsageQuery(config, resourceName)
+
+		vectorResult, err := promVectorRequest(config, query)
+		if err != nil {
+			return podMetricsList, err
+		}
+
+		for _, sample := range vectorResult {
+			namespace := string(sample.Metric["namespace"])
+			podName := string(sample.Metric["pod"])
+			containerName := string(sample.Metric["container"])
+
+			if namespace == "" || podName == "" {
+				return podMetricsList, fmt.Errorf("usage query %q must return namespace and pod labels, got %s", query, sample.Metric)
+			}
+
+			podKey := namespace + "/" + podName
+			podNum, exists := podMetricsIndex[podKey]
+			if !exists {
+				podNum = len(podMetricsList.Items)
+				podMetricsIndex[podKey] = podNum
+				podMetricsList.Items = append(podMetricsList.Items, v1beta1.PodMetrics{
+					ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: podName},
+				})
+			}
+			podMetrics := &podMetricsList.Items[podNum]
+
+			containerKey := podKey + "/" + containerName
+			containerNum, exists := containerIndex[containerKey]
+			if !exists {
+				containerNum = len(podMetrics.Containers)
+				containerIndex[containerKey] = containerNum
+				podMetrics.Containers = append(podMetrics.Containers, v1beta1.ContainerMetrics{
+					Name:  containerName,
+					Usage: v1.ResourceList{},
+				})
+			}
+
+			podMetrics.Containers[containerNum].Usage[resourceName] = sampleToQuantity(sample, resourceName)
+		}
+	}
+
+	logProm.Debug("usage from Prometheus", "pods", len(podMetricsList.Items), "window", getUsageWindow(config), "percentile", getUsagePercentile(config))
+	return podMetricsList, nil
+}
+
+// CPU is returned by Prometheus in cores, memory in bytes
+func sampleToQuantity(sample *model.Sample, resourceName v1.ResourceName) resource.Quantity {
+	if resourceName == v1.ResourceCPU {
+		return *resource.NewMilliQuantity(int64(float64(sample.Value)*1000), resource.DecimalSI)
+	}
+	return *resource.NewQuantity(int64(sample.Value), resource.BinarySI)
+}
+
+// Custom queries without verbs are used as is
+func getUsageQuery(config *configType, resourceName v1.ResourceName) string {
+	quantile := getUsagePercentile(config) / 100
+	query := usageDefaultMemoryQuery
+	args := []interface{}{quantile, getUsageWindow(config), getUsageResolution(config)}
+
+	if resourceName == v1.ResourceCPU {
+		query = usageDefaultCPUQuery
+		args = append(args, usageCPURateWindow)
+
+		if config.Usage.CPUQuery != "" {
+			query = config.Usage.CPUQuery
+		}
+	} else if config.Usage.MemoryQuery != "" {
+		query = config.Usage.MemoryQuery
+	}
+
+	if !strings.Contains(query, "%") {
+		return query
+	}
+	return fmt.Sprintf(query, args...)
+}
+
+func getUsageWindow(config *configType) string {
+	if config.Usage.Window == "" {
+		return usageDefaultWindow
+	}
+	return config.Usage.Window
+}
+
+func getUsageResolution(config *configType) string {
+	if config.Usage.Resolution == "" {
+		return usageDefaultResolution
+	}
+	return config.Usage.Resolution
+}
+
+func getUsagePercentile(config *configType) float64 {
+	if config.Usage.Percentile == 0 {
+		return usageDefaultPercentile
+	}
+	return config.Usage.Percentile
+}
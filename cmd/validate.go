@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Problem of the config, path is a list of keys and indexes leading to the wrong value
+type configProblemType struct {
+	Path    []interface{}
+	Line    int
+	Message string
+}
+
+var (
+	nodeSelectorOperators = []string{
+		string(v1.NodeSelectorOpIn),
+		string(v1.NodeSelectorOpNotIn),
+		string(v1.NodeSelectorOpExists),
+		string(v1.NodeSelectorOpDoesNotExist),
+		string(v1.NodeSelectorOpGt),
+		string(v1.NodeSelectorOpLt),
+	}
+	workloadKinds = []string{workloadKindDeployment, workloadKindStatefulSet, workloadKindDaemonSet, workloadKindRollout}
+
+	usageQueryResources = map[string]v1.ResourceName{"cpu_query": v1.ResourceCPU, "memory_query": v1.ResourceMemory}
+
+	yamlErrorLineRegexp    = regexp.MustCompile(`line (\d+): `)
+	yamlUnknownFieldRegexp = regexp.MustCompile(`field (\S+) not found in type .*`)
+)
+
+// Check the config and gather dependencies of every namespace
+func validateConfig(config *configType) error {
+	var err error
+	var problemErrors []error
+
+	for _, problem := range getConfigProblems(config) {
+		problemErrors = append(problemErrors, errors.New(problem.Message))
+	}
+	if len(problemErrors) > 0 {
+		return errors.Join(problemErrors...)
+	}
+
+	for nsNum, namespace := range config.Namespaces {
+		config.Namespaces[nsNum].DependsOnFullChain, err = getDependencies(config, namespace.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check the config file the way readConfig does, but strictly and reporting all problems with line numbers
+func validateConfigFile(configPath string) []configProblemType {
+	configData, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return []configProblemType{{Message: err.Error()}}
+	}
+
+	var root yaml.Node
+	err = yaml.Unmarshal(configData, &root)
+	if err != nil {
+		return []configProblemType{yamlErrorToProblem(err.Error())}
+	}
+
+	config := &configType{}
+	decoder := yaml.NewDecoder(bytes.NewReader(configData))
+	decoder.KnownFields(true)
+	err = decoder.Decode(config)
+
+	// The rest of the document is still decoded on type errors, so it is checked as well
+	var schemaProblems []configProblemType
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		for _, message := range typeErr.Errors {
+			schemaProblems = append(schemaProblems, yamlErrorToProblem(message))
+		}
+	} else if err != nil {
+		return []configProblemType{yamlErrorToProblem(err.Error())}
+	}
+
+	problems := getConfigProblems(config)
+	for problemNum := range problems {
+		problems[problemNum].Line = getConfigLine(&root, problems[problemNum].Path)
+	}
+	problems = append(schemaProblems, problems...)
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Line < problems[j].Line
+	})
+
+	return problems
+}
+
+// Check everything that can be checked without the cluster
+func getConfigProblems(config *configType) []configProblemType {
+	var problems []configProblemType
+	var namespaceNames []string
+
+	addProblem := func(path []interface{}, format string, args ...interface{}) {
+		problems = append(problems, configProblemType{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if config.Prometheus.Address == "" {
+		addProblem([]interface{}{"prometheus"}, "prometheus.address is empty")
+	}
+
+	auth := config.Prometheus.Auth
+	if auth.Basic.Username != "" && auth.BearerTokenFile != "" {
+		addProblem([]interface{}{"prometheus", "auth"}, "prometheus.auth.basic and bearer_token_file are mutually exclusive")
+	}
+	if auth.Basic.Password != "" && auth.Basic.PasswordFile != "" {
+		addProblem([]interface{}{"prometheus", "auth", "basic"}, "prometheus.auth.basic.password and password_file are mutually exclusive")
+	}
+	if auth.Basic.Username == "" && (auth.Basic.Password != "" || auth.Basic.PasswordFile != "") {
+		addProblem([]interface{}{"prometheus", "auth", "basic"}, "prometheus.auth.basic.username is empty")
+	}
+
+	tls := config.Prometheus.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		addProblem([]interface{}{"prometheus", "tls"}, "prometheus.tls.cert_file and key_file must be set together")
+	}
+
+	for name := range config.Prometheus.Headers {
+		if strings.EqualFold(name, "Authorization") {
+			addProblem([]interface{}{"prometheus", "headers", name}, "prometheus.headers.%s cannot be set, use prometheus.auth instead", name)
+		}
+	}
+
+	if !inList(config.Prometheus.RPSMode, []string{"", rpsModeInstant, rpsModeRange}) {
+		addProblem([]interface{}{"prometheus", "rps_mode"}, "unknown prometheus.rps_mode %q, must be %s or %s", config.Prometheus.RPSMode, rpsModeInstant, rpsModeRange)
+	}
+
+	if config.Prometheus.RPSAggregation != "" && !rpsAggregationIsValid(config.Prometheus.RPSAggregation) {
+		addProblem([]interface{}{"prometheus", "rps_aggregation"}, "unknown prometheus.rps_aggregation %q, must be %s, %s or a percentile like p99", config.Prometheus.RPSAggregation, rpsAggregationMax, rpsAggregationAvg)
+	}
+
+	lookback, step, err := getRPSRange(config)
+	if err != nil {
+		addProblem([]interface{}{"prometheus"}, "%v", err)
+	} else if step <= 0 || lookback <= 0 {
+		addProblem([]interface{}{"prometheus", "rps_step"}, "prometheus.rps_lookback and rps_step must be positive")
+	} else if lookback/step > prometheusMaxRangePoints {
+		addProblem([]interface{}{"prometheus", "rps_step"}, "prometheus.rps_lookback %s with rps_step %s needs %d points, Prometheus allows %d", lookback, step, lookback/step, prometheusMaxRangePoints)
+	}
+
+	if !inList(config.Forecast.Seasonality, []string{"", seasonalityNone, seasonalityDaily, seasonalityWeekly}) {
+		addProblem([]interface{}{"forecast", "seasonality"}, "unknown forecast.seasonality %q, must be %s, %s or %s", config.Forecast.Seasonality, seasonalityNone, seasonalityDaily, seasonalityWeekly)
+	}
+
+	if config.Forecast.HorizonDays < 0 {
+		addProblem([]interface{}{"forecast", "horizon_days"}, "forecast.horizon_days cannot be negative")
+	}
+
+	history, forecastStep, err := getForecastRange(config)
+	if err != nil {
+		addProblem([]interface{}{"forecast"}, "%v", err)
+	} else if forecastStep <= 0 || history <= 0 {
+		addProblem([]interface{}{"forecast", "step"}, "forecast.history and step must be positive")
+	} else if history/forecastStep > prometheusMaxRangePoints {
+		addProblem([]interface{}{"forecast", "step"}, "forecast.history %s with step %s needs %d points, Prometheus allows %d", history, forecastStep, history/forecastStep, prometheusMaxRangePoints)
+	} else if seasonality := getSeasonality(config, history); seasonality != seasonalityNone && day%forecastStep != 0 {
+		addProblem([]interface{}{"forecast", "step"}, "forecast.step %s must divide a day for %s seasonality", forecastStep, seasonality)
+	}
+
+	if !inList(config.NodeResources, []string{"", nodeResourcesAllocatable, nodeResourcesCapacity}) {
+		addProblem([]interface{}{"node_resources"}, "unknown node_resources %q, must be %s or %s", config.NodeResources, nodeResourcesAllocatable, nodeResourcesCapacity)
+	}
+
+	if !inList(config.Usage.Source, []string{"", usageSourceMetricsServer, usageSourcePrometheus}) {
+		addProblem([]interface{}{"usage", "source"}, "unknown usage.source %q, must be %s or %s", config.Usage.Source, usageSourceMetricsServer, usageSourcePrometheus)
+	}
+
+	if config.Usage.Percentile < 0 || config.Usage.Percentile > 100 {
+		addProblem([]interface{}{"usage", "percentile"}, "usage.percentile %v is not between 0 and 100", config.Usage.Percentile)
+	}
+
+	for key, duration := range map[string]string{"window": config.Usage.Window, "resolution": config.Usage.Resolution} {
+		_, err := model.ParseDuration(duration)
+		if duration != "" && err != nil {
+			addProblem([]interface{}{"usage", key}, "usage.%s %q is not a Prometheus duration: %v", key, duration, err)
+		}
+	}
+
+	for key, query := range map[string]string{"cpu_query": config.Usage.CPUQuery, "memory_query": config.Usage.MemoryQuery} {
+		if query != "" && strings.Contains(getUsageQuery(config, usageQueryResources[key]), "%!") {
+			addProblem([]interface{}{"usage", key}, "usage.%s has wrong verbs, only %%[1]v, %%[2]s, %%[3]s and %%[4]s (cpu only) are supported", key)
+		}
+	}
+
+	var resourceNames []string
+	for resourceNum, resourceName := range config.Resources {
+		path := []interface{}{"resources", resourceNum}
+
+		switch {
+		case resourceName == v1.ResourcePods:
+			addProblem(path, "resource %q is always counted as a constraint, remove it from resources", resourceName)
+		case inList(string(resourceName), resourceNames):
+			addProblem(path, "resource %q is listed twice", resourceName)
+		}
+		resourceNames = append(resourceNames, string(resourceName))
+	}
+
+	for affinityNum, affinity := range config.Affinity {
+		if !inList(string(affinity.Operator), nodeSelectorOperators) {
+			addProblem([]interface{}{"affinity", affinityNum, "operator"}, "unknown affinity operator %q, must be one of %s", affinity.Operator, strings.Join(nodeSelectorOperators, ", "))
+		}
+	}
+
+	for nsNum, namespace := range config.Namespaces {
+		path := []interface{}{"namespaces", nsNum}
+
+		if namespace.Name == "" {
+			addProblem(path, "namespace #%d has no name", nsNum+1)
+		} else if inList(namespace.Name, namespaceNames) {
+			addProblem(append(path, "name"), "namespace %s is described twice", namespace.Name)
+		}
+		namespaceNames = append(namespaceNames, namespace.Name)
+
+		if namespace.WorkloadKind != "" && !inList(strings.ToLower(namespace.WorkloadKind), workloadKinds) {
+			addProblem(append(path, "workload_kind"), "namespace %s: unknown workload_kind %q, must be one of %s", namespace.Name, namespace.WorkloadKind, strings.Join(workloadKinds, ", "))
+		}
+
+		if namespace.FrontendSuccessfulPercentage < 0 || namespace.FrontendSuccessfulPercentage > 100 {
+			addProblem(append(path, "frontend_successful_percentage"), "namespace %s: frontend_successful_percentage %v is not between 0 and 100", namespace.Name, namespace.FrontendSuccessfulPercentage)
+		}
+
+		if namespace.FrontendToSharedPercentage < 0 || namespace.FrontendToSharedPercentage > 100 {
+			addProblem(append(path, "frontend_to_shared_percentage"), "namespace %s: frontend_to_shared_percentage %v is not between 0 and 100", namespace.Name, namespace.FrontendToSharedPercentage)
+		}
+
+		if namespace.Prometheus.RPSAggregation != "" && !rpsAggregationIsValid(namespace.Prometheus.RPSAggregation) {
+			addProblem(append(path, "prometheus", "rps_aggregation"), "namespace %s: unknown rps_aggregation %q, must be %s, %s or a percentile like p99", namespace.Name, namespace.Prometheus.RPSAggregation, rpsAggregationMax, rpsAggregationAvg)
+		}
+
+		if namespace.Prometheus.QueryFullOverride == "" {
+			if config.Prometheus.QueryTemplate == "" {
+				addProblem(append(path, "prometheus"), "namespace %s: neither prometheus.query_template nor query_full_override is set", namespace.Name)
+			} else if namespace.Prometheus.QueryVariable == "" {
+				addProblem(append(path, "prometheus"), "namespace %s: prometheus.query_variable is empty", namespace.Name)
+			}
+		}
+	}
+
+	var scenarioNames []string
+	for scenarioNum, scenario := range config.Scenarios {
+		path := []interface{}{"scenarios", scenarioNum}
+
+		if scenario.Name == "" {
+			addProblem(path, "scenario #%d has no name", scenarioNum+1)
+		} else if inList(scenario.Name, scenarioNames) {
+			addProblem(append(path, "name"), "scenario %s is described twice", scenario.Name)
+		}
+		scenarioNames = append(scenarioNames, scenario.Name)
+
+		for frontendNum, frontend := range scenario.Frontends {
+			frontendPath := []interface{}{"scenarios", scenarioNum, "frontends", frontendNum}
+
+			if !inList(frontend.Name, namespaceNames) {
+				addProblem(frontendPath, "scenario %s: undescribed namespace %s", scenario.Name, frontend.Name)
+			} else if !namespaceIsFrontend(config, frontend.Name) {
+				addProblem(frontendPath, "scenario %s: namespace %s is not a frontend, only frontends RPS can be changed", scenario.Name, frontend.Name)
+			}
+
+			if (frontend.RPS != 0) == (frontend.RPSMultiplier != 0) {
+				addProblem(frontendPath, "scenario %s: exactly one of rps and rps_multiplier must be set for %s", scenario.Name, frontend.Name)
+			}
+
+			if frontend.RPS < 0 || frontend.RPSMultiplier < 0 {
+				addProblem(frontendPath, "scenario %s: RPS of %s cannot be negative", scenario.Name, frontend.Name)
+			}
+		}
+	}
+
+	// fmt marks wrong verbs and wrong amount of arguments with %!
+	if config.Prometheus.QueryTemplate != "" {
+		query := fmt.Sprintf(config.Prometheus.QueryTemplate, "")
+		if strings.Contains(query, "%!") {
+			addProblem([]interface{}{"prometheus", "query_template"}, "query_template must contain exactly one %%s verb (use %%%% for a literal %%), got %q", query)
+		}
+	}
+
+	for nsNum, namespace := range config.Namespaces {
+		for depNum, dependency := range namespace.DependsOn {
+			if !inList(dependency, namespaceNames) {
+				addProblem([]interface{}{"namespaces", nsNum, "depends_on", depNum}, "namespace %s depends on undescribed namespace %s", namespace.Name, dependency)
+			}
+		}
+	}
+
+	// Unknown dependencies are reported above, only loops are left
+	for nsNum, namespace := range config.Namespaces {
+		_, err := getDependencies(config, namespace.Name)
+		if err != nil && strings.HasPrefix(err.Error(), "dependency loop") {
+			addProblem([]interface{}{"namespaces", nsNum, "depends_on"}, "namespace %s: %v", namespace.Name, err)
+		}
+	}
+
+	return problems
+}
+
+func rpsAggregationIsValid(aggregation string) bool {
+	_, err := aggregateRPS([]float64{0}, aggregation)
+	return err == nil
+}
+
+func namespaceIsFrontend(config *configType, name string) bool {
+	for _, namespace := range config.Namespaces {
+		if namespace.Name == name {
+			return namespace.Frontend
+		}
+	}
+	return false
+}
+
+// Find the line of the value by the path, the line of the closest existing parent if the value is absent
+func getConfigLine(root *yaml.Node, path []interface{}) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+
+	for _, element := range path {
+		var next *yaml.Node
+
+		switch key := element.(type) {
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for contentNum := 0; contentNum+1 < len(node.Content); contentNum += 2 {
+					if node.Content[contentNum].Value == key {
+						line = node.Content[contentNum].Line
+						next = node.Content[contentNum+1]
+					}
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && key < len(node.Content) {
+				next = node.Content[key]
+				line = next.Line
+			}
+		}
+
+		if next == nil {
+			break
+		}
+		node = next
+	}
+
+	return line
+}
+
+// yaml errors look like "yaml: line 12: ..." or "line 12: ..."
+func yamlErrorToProblem(message string) configProblemType {
+	problem := configProblemType{Message: strings.TrimPrefix(message, "yaml: ")}
+
+	match := yamlErrorLineRegexp.FindStringSubmatchIndex(problem.Message)
+	if match != nil {
+		problem.Line, _ = strconv.Atoi(problem.Message[match[2]:match[3]])
+		problem.Message = problem.Message[:match[0]] + problem.Message[match[1]:]
+	}
+
+	// Config sections are anonymous structs, their type names are not readable
+	problem.Message = yamlUnknownFieldRegexp.ReplaceAllString(problem.Message, "unknown field $1")
+
+	return problem
+}
+
+// Print all problems of the config, return exit code for CI
+func runValidate(configPath string) int {
+	problems := validateConfigFile(configPath)
+
+	for _, problem := range problems {
+		if problem.Line > 0 {
+			fmt.Printf("%s:%d: %s\n", configPath, problem.Line, problem.Message)
+		} else {
+			fmt.Printf("%s: %s\n", configPath, problem.Message)
+		}
+	}
+
+	if len(problems) > 0 {
+		fmt.Printf("%s: %d problem(s) found\n", configPath, len(problems))
+		return 1
+	}
+
+	fmt.Printf("%s: OK\n", configPath)
+	return 0
+}
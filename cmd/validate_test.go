@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateConfigFile(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configPath, []byte(`prometheus:
+  address: http://prometheus:9090
+  query_template: 'sum(rate(requests{app="%s"}[1m]))'
+namespaces:
+  - name: shop
+    frontend: true
+    frontend_successful_percentage: 150
+    query_variable: shop
+    prometheus:
+      query_variable: shop
+  - name: shop
+    prometheus:
+      query_variable: shop
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems := validateConfigFile(configPath)
+
+	wantProblems := []configProblemType{
+		{Line: 7, Message: "namespace shop: frontend_successful_percentage 150 is not between 0 and 100"},
+		{Line: 8, Message: "unknown field query_variable"},
+		{Line: 11, Message: "namespace shop is described twice"},
+	}
+	if len(problems) != len(wantProblems) {
+		t.Fatalf("validateConfigFile() = %v, want %v", problems, wantProblems)
+	}
+	for problemNum, problem := range problems {
+		if problem.Line != wantProblems[problemNum].Line || problem.Message != wantProblems[problemNum].Message {
+			t.Errorf("problem %d = %d: %s, want %d: %s", problemNum, problem.Line, problem.Message, wantProblems[problemNum].Line, wantProblems[problemNum].Message)
+		}
+	}
+}
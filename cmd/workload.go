@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Values of workload_kind in config.yaml
+const (
+	workloadKindDeployment  = "deployment"
+	workloadKindStatefulSet = "statefulset"
+	workloadKindDaemonSet   = "daemonset"
+	workloadKindRollout     = "rollout"
+)
+
+var rolloutResource = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+
+// Common view of Deployments, StatefulSets, DaemonSets and Argo Rollouts
+type workloadType struct {
+	Kind      string
+	Namespace string
+	Name      string
+	UID       types.UID
+	Replicas  int64
+	Selector  labels.Selector
+	PodSpec   v1.PodSpec
+}
+
+// Get the workload of the specified kind from the informer cache
+func getWorkload(namespace, kind, name string) (workloadType, error) {
+	var labelSelector *metav1.LabelSelector
+	workload := workloadType{Kind: kind, Namespace: namespace, Name: name}
+
+	switch kind {
+	case workloadKindDeployment:
+		deployment, err := deploymentLister.Deployments(namespace).Get(name)
+		if err != nil {
+			return workload, err
+		}
+		recordDeployment(deployment)
+
+		workload.UID = deployment.UID
+		workload.Replicas = int64(replicasOrDefault(deployment.Spec.Replicas))
+		workload.PodSpec = deployment.Spec.Template.Spec
+		labelSelector = deployment.Spec.Selector
+
+	case workloadKindStatefulSet:
+		statefulSet, err := statefulSetLister.StatefulSets(namespace).Get(name)
+		if err != nil {
+			return workload, err
+		}
+		recordStatefulSet(statefulSet)
+
+		workload.UID = statefulSet.UID
+		workload.Replicas = int64(replicasOrDefault(statefulSet.Spec.Replicas))
+		workload.PodSpec = statefulSet.Spec.Template.Spec
+		labelSelector = statefulSet.Spec.Selector
+
+	case workloadKindDaemonSet:
+		daemonSet, err := daemonSetLister.DaemonSets(namespace).Get(name)
+		if err != nil {
+			return workload, err
+		}
+		recordDaemonSet(daemonSet)
+
+		workload.UID = daemonSet.UID
+		workload.Replicas = int64(daemonSet.Status.DesiredNumberScheduled)
+		workload.PodSpec = daemonSet.Spec.Template.Spec
+		labelSelector = daemonSet.Spec.Selector
+
+	case workloadKindRollout:
+		var err error
+		labelSelector, err = fillRolloutWorkload(&workload)
+		if err != nil {
+			return workload, err
+		}
+
+	default:
+		return workload, fmt.Errorf("unknown workload kind %q", kind)
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return workload, fmt.Errorf("invalid selector of %s %s/%s: %w", kind, namespace, name, err)
+	}
+	workload.Selector = selector
+
+	return workload, nil
+}
+
+// Argo Rollouts are read from the dynamic informer as unstructured objects
+func fillRolloutWorkload(workload *workloadType) (*metav1.LabelSelector, error) {
+	var labelSelector metav1.LabelSelector
+	var template v1.PodTemplateSpec
+
+	if rolloutLister == nil {
+		return nil, fmt.Errorf("rollout informer is not started")
+	}
+
+	object, err := rolloutLister.ByNamespace(workload.Namespace).Get(workload.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	rollout, isUnstructured := object.(*unstructured.Unstructured)
+	if !isUnstructured {
+		return nil, fmt.Errorf("unexpected rollout object type %T", object)
+	}
+
+	workload.UID = rollout.GetUID()
+
+	replicas, found, err := unstructured.NestedInt64(rollout.Object, "spec", "replicas")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		replicas = 1
+	}
+	workload.Replicas = replicas
+
+	selectorData, _, err := unstructured.NestedMap(rollout.Object, "spec", "selector")
+	if err != nil {
+		return nil, err
+	}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(selectorData, &labelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse selector of rollout %s/%s: %w", workload.Namespace, workload.Name, err)
+	}
+
+	// Rollout may reference a Deployment instead of having its own template
+	workloadRefName, hasWorkloadRef, _ := unstructured.NestedString(rollout.Object, "spec", "workloadRef", "name")
+	if hasWorkloadRef {
+		deployment, err := deploymentLister.Deployments(workload.Namespace).Get(workloadRefName)
+		if err != nil {
+			return nil, err
+		}
+		recordDeployment(deployment)
+
+		err = recordRollout(rollout, nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot record rollout %s/%s: %w", workload.Namespace, workload.Name, err)
+		}
+
+		workload.PodSpec = deployment.Spec.Template.Spec
+		if len(labelSelector.MatchLabels) == 0 && len(labelSelector.MatchExpressions) == 0 {
+			labelSelector = *deployment.Spec.Selector
+		}
+		return &labelSelector, nil
+	}
+
+	templateData, _, err := unstructured.NestedMap(rollout.Object, "spec", "template")
+	if err != nil {
+		return nil, err
+	}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(templateData, &template)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse template of rollout %s/%s: %w", workload.Namespace, workload.Name, err)
+	}
+	workload.PodSpec = template.Spec
+
+	err = recordRollout(rollout, &template)
+	if err != nil {
+		return nil, fmt.Errorf("cannot record rollout %s/%s: %w", workload.Namespace, workload.Name, err)
+	}
+
+	return &labelSelector, nil
+}
+
+// Get pods of the cycle's pod list which match the workload's selector and are controlled by it (directly or via its replicasets)
+func getWorkloadPods(workload *workloadType, allPodList *v1.PodList) (v1.PodList, error) {
+	var podList v1.PodList
+	owners := map[types.UID]bool{workload.UID: true}
+
+	// Deployments and Rollouts control their pods through replicasets
+	if workload.Kind == workloadKindDeployment || workload.Kind == workloadKindRollout {
+		owners = make(map[types.UID]bool)
+
+		replicaSets, err := replicaSetLister.ReplicaSets(workload.Namespace).List(workload.Selector)
+		if err != nil {
+			return podList, fmt.Errorf("cannot list replicasets: %w", err)
+		}
+		recordReplicaSets(replicaSets)
+
+		for _, replicaSet := range replicaSets {
+			owner := metav1.GetControllerOf(replicaSet)
+			if owner != nil && owner.UID == workload.UID {
+				owners[replicaSet.UID] = true
+			}
+		}
+	}
+
+	// Pods are not listed again, the same cluster state is used for the whole cycle
+	for _, pod := range allPodList.Items {
+		if pod.Namespace != workload.Namespace || !workload.Selector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+
+		owner := metav1.GetControllerOf(&pod)
+		if owner != nil && owners[owner.UID] {
+			podList.Items = append(podList.Items, pod)
+		}
+	}
+
+	return podList, nil
+}
+
+func replicasOrDefault(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}